@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/stdlog"
 	"github.com/disq/data-api-server/server"
 	"os"
@@ -11,23 +13,136 @@ import (
 
 func main() {
 	dataDir := flag.String("datadir", "/tmp", "Path to data directory")
+	pathTemplate := flag.String("path", server.DEFAULT_PATH_TEMPLATE, "Path template of the storage files under datadir. Can be overridden per event type")
+	storageFormat := flag.String("format", server.STORAGE_FORMAT_TSV, "Storage file format: tsv, ndjson or parquet. Can be overridden per event type")
+	compression := flag.String("compression", server.COMPRESSION_NONE, "Storage file compression: none, gzip or zstd. Can be overridden per event type")
+	partition := flag.String("partition", server.PARTITION_RECEIVED, "Partition files by the time the event is received (received) or by the ts of the event (event). Can be overridden per event type")
+	maxOpenFiles := flag.Int("maxopenfiles", 0, "Files kept open at the same time by each event type (default 1 with received partitioning, 25 with event partitioning)")
+	idleClose := flag.Duration("idleclose", 0, "Close files which haven't been written to for this long, 0 to disable (default 0 with received partitioning, 5m with event partitioning)")
+	maxBytes := flag.Int64("maxbytes", 0, "Start a new file when the current one reaches this size in bytes, 0 to disable. Can be overridden per event type")
+	maxRecords := flag.Int64("maxrecords", 0, "Start a new file when the current one has this many records, 0 to disable. Can be overridden per event type")
+	maxAge := flag.Duration("maxage", 0, "Start a new file when the current one is this old, 0 to disable. Can be overridden per event type")
+	finalize := flag.String("finalize", server.FINALIZE_NONE, "Mark closed files as complete: none, done (create a <file>.done marker) or rename (write to <file>.inprogress and rename). Can be overridden per event type")
+	retention := flag.Duration("retention", 0, "Remove files this long after the end of their hour (or day, etc. by -path), 0 to keep them. Can be overridden per event type")
+	retentionBytes := flag.Int64("retentionbytes", 0, "Remove the oldest files of each event type when they take up more than this many bytes, 0 for unlimited. Can be overridden per event type")
+	archiveDir := flag.String("archivedir", "", "Move expired files to this directory instead of removing them. Can be overridden per event type")
+	retentionDryRun := flag.Bool("retentiondryrun", false, "Only log the files which would be expired")
+	durability := flag.String("durability", server.DURABILITY_NONE, "When written events are flushed and fsynced: none (when the file is closed), periodic (every -syncinterval) or sync (before the event is accepted). Can be overridden per event type")
+	syncInterval := flag.Duration("syncinterval", server.DEFAULT_SYNC_INTERVAL, "Sync interval for periodic durability")
+	queueSize := flag.Int("queuesize", server.DEFAULT_QUEUE_SIZE, "Events waiting to be written by each event type. Can be overridden per event type")
+	queueFull := flag.String("queuefull", server.QUEUE_FULL_BLOCK, "When the queue is full: block (wait up to -queuetimeout, then respond with 503) or reject (respond with 503 immediately). Can be overridden per event type")
+	queueTimeout := flag.Duration("queuetimeout", server.DEFAULT_QUEUE_TIMEOUT, "How long to wait for a full queue in block mode. Can be overridden per event type")
+	spoolDir := flag.String("spooldir", "", "Directory of the write-ahead spool. If set, events are persisted here before they're accepted, and delivered to storage in the background")
+	spoolSegmentSize := flag.Int64("spoolsegmentsize", server.DEFAULT_SPOOL_SEGMENT_SIZE, "Size of spool segment files in bytes")
+	spoolMaxBytes := flag.Int64("spoolmaxbytes", 0, "Reject events if the spool of the event type reaches this size in bytes, 0 for unlimited")
+	spoolSync := flag.Bool("spoolsync", false, "fsync the spool before accepting events")
 	listenIp := flag.String("host", "0.0.0.0", "IP to bind to")
 	listenPort := flag.Int("port", 8080, "Port to listen to")
+	maxBodySize := flag.Int64("maxbody", server.DEFAULT_MAX_BODY_SIZE, "Maximum request body size in bytes for POST requests")
+	maxBatchBodySize := flag.Int64("maxbatchbody", server.DEFAULT_MAX_BATCH_BODY_SIZE, "Maximum request body size in bytes for batch requests")
 
 	redisInfo := flag.String("redis", "127.0.0.1:6379:0", "Redis <host>:<port>:<db>")
 
+	eventsFile := flag.String("events", "", "Path to event types config file (YAML or JSON). If not set, default event types are registered")
+	adminToken := flag.String("admintoken", "", "Token for admin endpoints, sent in the X-Admin-Token header. If not set, admin endpoints are only accessible from localhost")
+
 	flag.Parse()
 	logger := stdlog.GetFromFlags()
 
+	if flag.Arg(0) == "repair" {
+		repair(flag.Args()[1:], logger)
+		return
+	}
+
 	// Sanitize Params
 	if _, err := os.Stat(*dataDir); err != nil {
 		logger.Errorf("Error stat %s: %v", *dataDir, err)
 		panic(err)
 	}
+	if _, err := server.ParsePathTemplate(*pathTemplate); err != nil {
+		logger.Error("Invalid path template:", err)
+		panic(err)
+	}
+	if !server.IsValidStorageFormat(*storageFormat) {
+		logger.Error("Invalid storage format", *storageFormat)
+		panic("Invalid storage format")
+	}
+	if !server.IsValidCompression(*compression) {
+		logger.Error("Invalid compression", *compression)
+		panic("Invalid compression")
+	}
+	if *partition != server.PARTITION_RECEIVED && *partition != server.PARTITION_EVENT {
+		logger.Error("Invalid partition mode", *partition)
+		panic("Invalid partition mode")
+	}
+	if *maxOpenFiles < 0 || *idleClose < 0 {
+		logger.Error("Invalid max open files or idle close timeout")
+		panic("Invalid max open files or idle close timeout")
+	}
+	if *maxBytes < 0 || *maxRecords < 0 || *maxAge < 0 {
+		logger.Error("Invalid rotation threshold")
+		panic("Invalid rotation threshold")
+	}
+	if *finalize != server.FINALIZE_NONE && *finalize != server.FINALIZE_DONE && *finalize != server.FINALIZE_RENAME {
+		logger.Error("Invalid finalize mode", *finalize)
+		panic("Invalid finalize mode")
+	}
+	if *retention < 0 || *retentionBytes < 0 {
+		logger.Error("Invalid retention")
+		panic("Invalid retention")
+	}
+	if *archiveDir != "" {
+		if _, err := os.Stat(*archiveDir); err != nil {
+			logger.Errorf("Error stat %s: %v", *archiveDir, err)
+			panic(err)
+		}
+	}
+	if *durability != server.DURABILITY_NONE && *durability != server.DURABILITY_PERIODIC && *durability != server.DURABILITY_SYNC {
+		logger.Error("Invalid durability mode", *durability)
+		panic("Invalid durability mode")
+	}
+	if *durability == server.DURABILITY_SYNC && *storageFormat == server.STORAGE_FORMAT_PARQUET {
+		logger.Errorf("Durability mode %s can't be used with the %s format", *durability, *storageFormat)
+		panic("Invalid durability mode")
+	}
+	if *syncInterval <= 0 {
+		logger.Error("Invalid sync interval", *syncInterval)
+		panic("Invalid sync interval")
+	}
+	if *queueSize < 1 {
+		logger.Error("Invalid queue size", *queueSize)
+		panic("Invalid queue size")
+	}
+	if *queueFull != server.QUEUE_FULL_BLOCK && *queueFull != server.QUEUE_FULL_REJECT {
+		logger.Error("Invalid queue full mode", *queueFull)
+		panic("Invalid queue full mode")
+	}
+	if *queueTimeout <= 0 {
+		logger.Error("Invalid queue timeout", *queueTimeout)
+		panic("Invalid queue timeout")
+	}
+	if *spoolDir != "" {
+		if _, err := os.Stat(*spoolDir); err != nil {
+			logger.Errorf("Error stat %s: %v", *spoolDir, err)
+			panic(err)
+		}
+	}
+	if *spoolSegmentSize < 1 || *spoolMaxBytes < 0 {
+		logger.Error("Invalid spool segment size or max bytes")
+		panic("Invalid spool segment size or max bytes")
+	}
 	if *listenPort < 1 || *listenPort > 65535 {
 		logger.Error("Invalid port", *listenPort)
 		panic("Invalid port")
 	}
+	if *maxBodySize < 1 {
+		logger.Error("Invalid max body size", *maxBodySize)
+		panic("Invalid max body size")
+	}
+	if *maxBatchBodySize < 1 {
+		logger.Error("Invalid max batch body size", *maxBatchBodySize)
+		panic("Invalid max batch body size")
+	}
 
 	redisParts := strings.Split(*redisInfo, ":")
 	if len(redisParts) != 3 {
@@ -50,52 +165,106 @@ func main() {
 		panic("Invalid redis db")
 	}
 
-	stats := server.NewStats(&server.StatsConfig{redisHost, redisPort, redisDb}, logger)
+	stats := server.NewStats(&server.StatsConfig{Host: redisHost, Port: redisPort, Database: redisDb}, logger)
 
 	// Register Events
-	eventNames := []string{
+	eventsConfig := server.DefaultEventsConfig([]string{
 		"session_start",
 		"session_end",
 		"link_clicked",
+	})
+	if *eventsFile != "" {
+		eventsConfig, err = server.LoadEventsConfig(*eventsFile)
+		if err != nil {
+			logger.Error(err)
+			panic(err)
+		}
 	}
 
-	// Here we initialize separate Storage instances for each event type.
+	// Here we initialize separate Sink instances for each event type.
 	// Since each event type will be stored to its own file, there's no reason not to do it in parallel.
 
-	// Iterate event names and create EventTypes, initialize separate Storage worker for each EventType
-	et := make([]server.EventType, len(eventNames))
-	for i, n := range eventNames {
-		e := server.NewEventType(n)
-		e.Storage = server.NewStorage(&server.StorageConfig{
-			DataDir: *dataDir,
-		}, logger)
-
-		et[i] = e
+	// Create EventTypes, initialize and run separate Sink (by default a Storage worker) for each EventType
+	registry := server.NewRegistry(&server.StorageConfig{
+		DataDir:         *dataDir,
+		Path:            *pathTemplate,
+		Format:          *storageFormat,
+		Compression:     *compression,
+		Partition:       *partition,
+		MaxOpenFiles:    *maxOpenFiles,
+		IdleClose:       *idleClose,
+		MaxBytes:        *maxBytes,
+		MaxRecords:      *maxRecords,
+		MaxAge:          *maxAge,
+		Finalize:        *finalize,
+		Retention:       *retention,
+		RetentionBytes:  *retentionBytes,
+		ArchiveDir:      *archiveDir,
+		RetentionDryRun: *retentionDryRun,
+		Durability:      *durability,
+		SyncInterval:    *syncInterval,
+		QueueSize:       *queueSize,
+		QueueFull:       *queueFull,
+		QueueTimeout:    *queueTimeout,
+		Redis:           stats.Pool,
+	}, logger)
+	registry.Spool = &server.SpoolConfig{
+		Dir:         *spoolDir,
+		SegmentSize: *spoolSegmentSize,
+		MaxBytes:    *spoolMaxBytes,
+		Sync:        *spoolSync,
 	}
-
-	// Run Storage workers
-	for _, e := range et {
-		e.Storage.RunInBackground()
+	if _, err := registry.Load(eventsConfig); err != nil {
+		logger.Error(err)
+		panic(err)
 	}
 
 	// Configure Server
 	config := &server.ServerConfig{
-		ListenIp:      *listenIp,
-		ListenPort:    *listenPort,
-		RedisHost:     redisHost,
-		RedisPort:     redisPort,
-		RedisDatabase: redisDb,
-		EventTypes:    et,
+		ListenIp:         *listenIp,
+		ListenPort:       *listenPort,
+		RedisHost:        redisHost,
+		RedisPort:        redisPort,
+		RedisDatabase:    redisDb,
+		MaxBodySize:      *maxBodySize,
+		MaxBatchBodySize: *maxBatchBodySize,
+		Events:           registry,
+		EventsFile:       *eventsFile,
+		AdminToken:       *adminToken,
 	}
 
 	// Run
 	server.NewServer(config, stats, logger).Run()
 
-	// Wait for all storage workers to stop
-	for _, e := range et {
-		e.Storage.Stop()
-	}
+	// Deliver spooled events and wait for all storage workers to stop
+	registry.Close()
 
 	stats.Close()
 	logger.Info("Goodbye!")
 }
+
+// repair repairs the storage files in a data directory, while the server is not running
+func repair(args []string, logger log.Logger) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := fs.Bool("dryrun", false, "Only report the files which need a repair")
+	finalize := fs.Bool("finalize", false, "Rename "+server.INPROGRESS_SUFFIX+" files to their final names")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-stderr] repair [-dryrun] [-finalize] <datadir>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	n, err := server.RepairDir(fs.Arg(0), *finalize, *dryRun, logger)
+	if *dryRun {
+		logger.Infof("%d files need a repair", n)
+	} else {
+		logger.Infof("%d files repaired", n)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
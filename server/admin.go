@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// adminMiddleware only lets requests with the admin token through. If there's no admin token, only requests from loopback addresses are allowed.
+func (s *Server) adminMiddleware(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.Config.AdminToken != "" {
+			token := req.Header.Get("X-Admin-Token")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) != 1 {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+		} else {
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		fn(w, req)
+	}
+}
+
+// ReloadEvents re-reads the event types config file and swaps the registry
+func (s *Server) ReloadEvents() (*ReloadResult, error) {
+	if s.Config.EventsFile == "" {
+		err := errors.New("No events config file to reload from")
+		s.Logger.Error(err)
+		return nil, err
+	}
+
+	c, err := LoadEventsConfig(s.Config.EventsFile)
+	if err != nil {
+		s.Logger.Errorf("Could not reload event types, keeping the current ones: %v", err)
+		return nil, err
+	}
+
+	res, err := s.Config.Events.Load(c)
+	if err != nil {
+		s.Logger.Errorf("Could not reload event types, keeping the current ones: %v", err)
+		return nil, err
+	}
+
+	s.Logger.Infof("Reloaded event types from %s. Added: %v Removed: %v Updated: %v", s.Config.EventsFile, res.Added, res.Removed, res.Updated)
+	return res, nil
+}
+
+func (s *Server) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.Logger.Infof("Reload request from %s", req.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	res, err := s.ReloadEvents()
+	if err != nil {
+		jsonData, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(jsonData)
+		return
+	}
+
+	jsonData, _ := json.Marshal(res)
+	w.Write(jsonData)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const DEFAULT_MAX_BATCH_BODY_SIZE = 10 << 20 // 10 MiB
+
+type batchItemResult struct {
+	Status int          `json:"status"`
+	Error  string       `json:"error,omitempty"`
+	Params []ParamError `json:"params,omitempty"` // Failed params, if the item didn't pass validation
+
+	RetryAfter int `json:"retry_after,omitempty"` // Seconds, if the item should be retried later
+}
+
+var errBatchItemNotObject = errors.New("Item should be a JSON object")
+var errBatchItemNoEvent = errors.New("Item should have a string \"event\" field")
+
+// batchHandler accepts multiple events in a single request, either as a JSON array or as newline delimited JSON objects.
+// Each item is processed separately and the response is an array of per-item results, in the same order as the items.
+func (s *Server) batchHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-control", "priviate, max-age=0, no-cache")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "-1")
+
+	s.Logger.Debugf("Batch request from %s: %s %s", req.RemoteAddr, req.Method, req.URL.RequestURI())
+
+	switch req.Method {
+	case "POST":
+	case "OPTIONS":
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, s.Config.MaxBatchBodySize)
+
+	// The whole batch is read first, so that nothing is stored if it's rejected
+	var items [][]byte
+	read := func(raw []byte) {
+		items = append(items, raw)
+	}
+
+	switch mediaType {
+	case "application/json":
+		err = readJSONArray(req.Body, read)
+	case "application/x-ndjson", "application/jsonlines", "application/x-jsonlines":
+		err = readNDJSON(req.Body, read)
+	default:
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err != nil {
+		if bodyError(err) == errBodyTooLarge {
+			http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.Logger.Debugf("Invalid batch from %s: %v", req.RemoteAddr, err)
+		s.badRequest(w, req)
+		return
+	}
+
+	results := make([]batchItemResult, len(items))
+	for i, raw := range items {
+		results[i] = s.handleBatchItem(raw)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	jsonData, _ := json.Marshal(results)
+	w.Write(jsonData)
+}
+
+func (s *Server) handleBatchItem(raw []byte) batchItemResult {
+	var item map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&item); err != nil || item == nil {
+		return batchItemResult{Status: http.StatusBadRequest, Error: errBatchItemNotObject.Error()}
+	}
+	if _, err := dec.Token(); err != io.EOF { // ie. a NDJSON line with something after the object
+		return batchItemResult{Status: http.StatusBadRequest, Error: errBatchItemNotObject.Error()}
+	}
+
+	name, ok := item["event"].(string)
+	if !ok {
+		return batchItemResult{Status: http.StatusBadRequest, Error: errBatchItemNoEvent.Error()}
+	}
+	delete(item, "event")
+
+	if err := s.handleEvent(&EventRecord{
+		name: name,
+		data: item,
+	}); err != nil {
+		switch err := err.(type) {
+		case *ValidationError:
+			return batchItemResult{Status: http.StatusBadRequest, Error: "Invalid params", Params: err.Params}
+		case *UnavailableError:
+			return batchItemResult{Status: http.StatusServiceUnavailable, Error: err.Error(), RetryAfter: err.retryAfterSeconds()}
+		}
+		return batchItemResult{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	return batchItemResult{Status: http.StatusOK}
+}
+
+// readJSONArray calls fn for each element of a JSON array. Only the array itself has to be valid JSON, elements are validated by the caller.
+func readJSONArray(r io.Reader, fn func([]byte)) error {
+	dec := json.NewDecoder(r)
+
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '[' {
+		return errors.New("Batch should be a JSON array")
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		fn(raw)
+	}
+
+	if _, err := dec.Token(); err != nil { // Closing bracket
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("Unexpected data after JSON array")
+	}
+	return nil
+}
+
+// readNDJSON calls fn for each non-empty line. Invalid lines don't invalidate the whole batch.
+func readNDJSON(r io.Reader, fn func([]byte)) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			fn(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
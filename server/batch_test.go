@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/alexcesaro/log"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testBatchServer(maxBody int64) (*Server, *testSink) {
+	sink := &testSink{}
+	reg := NewRegistry(&StorageConfig{}, log.NullLogger)
+	reg.types["a"] = &EventType{Name: "a", Sink: sink}
+	return NewServer(&ServerConfig{Events: reg, MaxBatchBodySize: maxBody}, nil, log.NullLogger), sink
+}
+
+func TestBatchHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		maxBody     int64
+		status      int
+		results     []int // Statuses of the items
+		stored      int
+	}{
+		{"array", "POST", "application/json", `[{"event":"a","x":1},{"event":"b"},{"x":1},"a",{"event":"a"}]`, 0, 200, []int{200, 400, 400, 400, 200}, 2},
+		{"empty array", "POST", "application/json", `[]`, 0, 200, []int{}, 0},
+		{"ndjson", "POST", "application/x-ndjson; charset=utf-8", "{\"event\":\"a\"}\n\n{\"event\":\"a\",\"x\":[1,2]}\n[]\n{\"event\":\"a\"} xyz\n{\"event\":\"a\"}", 0, 200, []int{200, 200, 400, 400, 200}, 3},
+		{"syntax error partway", "POST", "application/json", `[{"event":"a"},{"event":"a"},{"event":`, 0, 400, nil, 0},
+		{"not an array", "POST", "application/json", `{"event":"a"}`, 0, 400, nil, 0},
+		{"data after the array", "POST", "application/json", `[{"event":"a"}] []`, 0, 400, nil, 0},
+		{"too large array", "POST", "application/json", `[{"event":"a"},{"event":"a"},{"event":"a","x":"` + strings.Repeat("x", 100) + `"}]`, 64, 413, nil, 0},
+		{"too large ndjson", "POST", "application/x-ndjson", "{\"event\":\"a\"}\n{\"event\":\"a\"}\n{\"event\":\"a\",\"x\":\"" + strings.Repeat("x", 100) + "\"}\n", 64, 413, nil, 0},
+		{"unsupported type", "POST", "text/plain", `[]`, 0, 415, nil, 0},
+		{"no type", "POST", "", `[]`, 0, 415, nil, 0},
+		{"get", "GET", "", "", 0, 405, nil, 0},
+		{"options", "OPTIONS", "", "", 0, 204, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, sink := testBatchServer(tt.maxBody)
+			req := httptest.NewRequest(tt.method, "/v1/batch", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.batchHandler(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status is %d, should be %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.results != nil {
+				var results []batchItemResult
+				if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+					t.Fatalf("invalid response %s: %v", w.Body, err)
+				}
+				statuses := make([]int, len(results))
+				for i, r := range results {
+					statuses[i] = r.Status
+				}
+				if !reflect.DeepEqual(statuses, tt.results) {
+					t.Errorf("item statuses are %v, should be %v", statuses, tt.results)
+				}
+			}
+			if len(sink.records) != tt.stored {
+				t.Errorf("%d items were stored, should be %d", len(sink.records), tt.stored)
+			}
+		})
+	}
+}
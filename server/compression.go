@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sort"
+)
+
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+// compressWriter is a compressed stream on top of an output file
+type compressWriter interface {
+	io.Writer
+	// Flush writes the compressed data so far, so the file can be decoded up to this point
+	Flush() error
+	// Close finalizes the stream. It doesn't close the underlying writer.
+	Close() error
+}
+
+type compression struct {
+	ext          string // Appended to the file extension
+	newWriter    func(w io.Writer) (compressWriter, error)
+	newReader    func(r io.Reader) (io.ReadCloser, error) // Reads concatenated streams as one
+	parquetCodec int32                                    // Page compression codec, parquet files are not wrapped
+}
+
+var compressions = map[string]compression{
+	COMPRESSION_NONE: {"", nil, nil, parquetCodecUncompressed},
+	COMPRESSION_GZIP: {".gz", newGzipWriter, newGzipReader, parquetCodecGzip},
+	COMPRESSION_ZSTD: {".zst", newZstdWriter, newZstdReader, parquetCodecZstd},
+}
+
+func IsValidCompression(name string) bool {
+	_, ok := compressions[name]
+	return ok
+}
+
+func compressionNames() []string {
+	names := make([]string, 0, len(compressions))
+	for n := range compressions {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newGzipWriter(w io.Writer) (compressWriter, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func newZstdWriter(w io.Writer) (compressWriter, error) {
+	// One Storage worker per file, no need for concurrency. Keep the memory usage down since there can be a lot of open files.
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+}
+
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// compressBlock compresses a whole block of data, ie. a parquet page
+func compressBlock(name string, data []byte) ([]byte, error) {
+	newWriter := compressions[name].newWriter
+	if newWriter == nil {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	cw, err := newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
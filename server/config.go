@@ -0,0 +1,517 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// EventsConfig is the event type registry, read from the file given with the -events flag
+type EventsConfig struct {
+	Events []EventTypeConfig `json:"events" yaml:"events"`
+}
+
+type EventTypeConfig struct {
+	Name       string                `json:"name" yaml:"name"`
+	Stats      *bool                 `json:"stats" yaml:"stats"` // Enabled if omitted
+	Storage    EventStorageConfig    `json:"storage" yaml:"storage"`
+	Sinks      []EventStorageConfig  `json:"sinks" yaml:"sinks"` // Instead of storage, to send the events to multiple sinks
+	Validation EventValidationConfig `json:"validation" yaml:"validation"`
+}
+
+// EventStorageConfig selects and configures a Sink of an event type. Empty settings are filled in from the global storage settings.
+type EventStorageConfig struct {
+	Type        string `json:"type" yaml:"type"`             // One of the registered sink types, "file" by default
+	Name        string `json:"name" yaml:"name"`             // Unique in the event type, the type by default
+	OnFailure   string `json:"on_failure" yaml:"on_failure"` // One of the ON_FAILURE_ constants
+	DataDir     string `json:"datadir" yaml:"datadir"`
+	Path        string `json:"path" yaml:"path"`               // Path template of the files under the data directory
+	Format      string `json:"format" yaml:"format"`           // File format, one of the STORAGE_FORMAT_ constants
+	Compression string `json:"compression" yaml:"compression"` // One of the COMPRESSION_ constants
+
+	Partition    string   `json:"partition" yaml:"partition"`           // One of the PARTITION_ constants
+	MaxOpenFiles int      `json:"max_open_files" yaml:"max_open_files"` // Defaults depend on the partition mode
+	IdleClose    Duration `json:"idle_close" yaml:"idle_close"`
+
+	MaxBytes   int64    `json:"max_bytes" yaml:"max_bytes"` // Rotation thresholds, 0 to disable
+	MaxRecords int64    `json:"max_records" yaml:"max_records"`
+	MaxAge     Duration `json:"max_age" yaml:"max_age"`
+	Finalize   string   `json:"finalize" yaml:"finalize"` // One of the FINALIZE_ constants
+
+	Retention       Duration `json:"retention" yaml:"retention"`             // Expire files this long after their hour, 0 to keep them
+	RetentionBytes  int64    `json:"retention_bytes" yaml:"retention_bytes"` // Expire the oldest files above this total size, 0 for unlimited
+	ArchiveDir      string   `json:"archive_dir" yaml:"archive_dir"`         // Move expired files here instead of removing them
+	RetentionDryRun bool     `json:"retention_dry_run" yaml:"retention_dry_run"`
+
+	Durability   string   `json:"durability" yaml:"durability"` // One of the DURABILITY_ constants
+	SyncInterval Duration `json:"sync_interval" yaml:"sync_interval"`
+
+	QueueSize    int      `json:"queue_size" yaml:"queue_size"`
+	QueueFull    string   `json:"queue_full" yaml:"queue_full"` // One of the QUEUE_FULL_ constants
+	QueueTimeout Duration `json:"queue_timeout" yaml:"queue_timeout"`
+
+	S3      *S3Config      `json:"s3" yaml:"s3"`           // For the s3 sink type
+	Kafka   *KafkaConfig   `json:"kafka" yaml:"kafka"`     // For the kafka sink type
+	Redis   *RedisConfig   `json:"redis" yaml:"redis"`     // For the redis sink type
+	Webhook *WebhookConfig `json:"webhook" yaml:"webhook"` // For the webhook sink type
+	SQLite  *SQLiteConfig  `json:"sqlite" yaml:"sqlite"`   // For the sqlite sink type
+
+	redisPool *redis.Pool // From the global settings
+}
+
+// Duration is a time.Duration, written as a string like "5m" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"5m\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return fmt.Errorf("duration should be a string like \"5m\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("duration can't be negative")
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type EventValidationConfig struct {
+	Required []string              `json:"required" yaml:"required"` // These params should be present
+	Allowed  []string              `json:"allowed" yaml:"allowed"`   // If not empty, only these params (and ts, and params with rules) are accepted
+	Params   map[string]*ParamRule `json:"params" yaml:"params"`
+}
+
+// Event names end up in URLs and file names, so they can't start with a dot (ie. "..")
+var eventNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// These can't be used as event names, since they have their own handlers under /v1/
+var reservedEventNames = []string{"batch"}
+
+func LoadEventsConfig(path string) (*EventsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &EventsConfig{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	} else {
+		err = yaml.UnmarshalStrict(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config in %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *EventsConfig) Validate() error {
+	if len(c.Events) == 0 {
+		return fmt.Errorf("No events defined")
+	}
+
+	seen := make(map[string]int, len(c.Events))
+	for i, e := range c.Events {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("events[%d] (%s): %v", i, e.Name, err)
+		}
+		if j, ok := seen[e.Name]; ok {
+			return fmt.Errorf("events[%d] (%s): name already used by events[%d]", i, e.Name, j)
+		}
+		seen[e.Name] = i
+	}
+	return nil
+}
+
+func (c *EventTypeConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name: can't be empty")
+	}
+	if !eventNameRegexp.MatchString(c.Name) {
+		return fmt.Errorf("name: should only contain letters, digits, '_', '.' and '-', and not start with '.'")
+	}
+	for _, n := range reservedEventNames {
+		if c.Name == n {
+			return fmt.Errorf("name: %s is reserved", n)
+		}
+	}
+
+	if len(c.Sinks) == 0 {
+		if err := c.Storage.validate(); err != nil {
+			return fmt.Errorf("storage.%v", err)
+		}
+	} else if !reflect.DeepEqual(c.Storage, EventStorageConfig{}) {
+		return fmt.Errorf("storage: can't be used together with sinks")
+	}
+	seen := make(map[string]int, len(c.Sinks))
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("sinks[%d].%v", i, err)
+		}
+		name := s.sinkName()
+		if j, ok := seen[name]; ok {
+			return fmt.Errorf("sinks[%d].name: %s already used by sinks[%d]", i, name, j)
+		}
+		seen[name] = i
+	}
+
+	if _, err := NewSchema(&c.Validation); err != nil {
+		return fmt.Errorf("validation.%v", err)
+	}
+
+	return nil
+}
+
+func (c *EventStorageConfig) validate() error {
+	if c.Type != "" {
+		if reason, ok := unavailableSinks[c.Type]; ok {
+			return fmt.Errorf("type: %s", reason)
+		}
+		if _, ok := sinkFactories[c.Type]; !ok {
+			return fmt.Errorf("type: unknown type %s, should be one of %s", c.Type, strings.Join(sinkTypes(), ", "))
+		}
+	}
+	if c.Name != "" && !eventNameRegexp.MatchString(c.Name) {
+		return fmt.Errorf("name: should only contain letters, digits, '_', '.' and '-', and not start with '.'")
+	}
+	switch c.OnFailure {
+	case "", ON_FAILURE_REJECT, ON_FAILURE_DROP:
+	default:
+		return fmt.Errorf("on_failure: unknown policy %s, should be %s or %s", c.OnFailure, ON_FAILURE_REJECT, ON_FAILURE_DROP)
+	}
+	if c.DataDir != "" {
+		if _, err := os.Stat(c.DataDir); err != nil {
+			return fmt.Errorf("datadir: %v", err)
+		}
+	}
+	if c.Path != "" {
+		if _, err := ParsePathTemplate(c.Path); err != nil {
+			return fmt.Errorf("path: %v", err)
+		}
+	}
+	if c.Format != "" {
+		if _, ok := storageFormats[c.Format]; !ok {
+			return fmt.Errorf("format: unknown format %s, should be one of %s", c.Format, strings.Join(storageFormatNames(), ", "))
+		}
+	}
+	switch c.Partition {
+	case "", PARTITION_RECEIVED, PARTITION_EVENT:
+	default:
+		return fmt.Errorf("partition: unknown partition mode %s, should be %s or %s", c.Partition, PARTITION_RECEIVED, PARTITION_EVENT)
+	}
+	if c.MaxOpenFiles < 0 {
+		return fmt.Errorf("max_open_files: can't be negative")
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes: can't be negative")
+	}
+	if c.MaxRecords < 0 {
+		return fmt.Errorf("max_records: can't be negative")
+	}
+	switch c.Finalize {
+	case "", FINALIZE_NONE, FINALIZE_DONE, FINALIZE_RENAME:
+	default:
+		return fmt.Errorf("finalize: unknown mode %s, should be %s, %s or %s", c.Finalize, FINALIZE_NONE, FINALIZE_DONE, FINALIZE_RENAME)
+	}
+	if c.Type == SINK_TYPE_S3 && c.Finalize != "" && c.Finalize != FINALIZE_RENAME {
+		return fmt.Errorf("finalize: s3 sinks always use %s", FINALIZE_RENAME)
+	}
+	if c.RetentionBytes < 0 {
+		return fmt.Errorf("retention_bytes: can't be negative")
+	}
+	if c.ArchiveDir != "" {
+		if _, err := os.Stat(c.ArchiveDir); err != nil {
+			return fmt.Errorf("archive_dir: %v", err)
+		}
+	}
+	if c.Type != "" && c.Type != SINK_TYPE_FILE && (c.Retention > 0 || c.RetentionBytes > 0 || c.ArchiveDir != "" || c.RetentionDryRun) {
+		return fmt.Errorf("retention: only used by file sinks")
+	}
+	switch c.Durability {
+	case "", DURABILITY_NONE, DURABILITY_PERIODIC, DURABILITY_SYNC:
+	default:
+		return fmt.Errorf("durability: unknown mode %s, should be %s, %s or %s", c.Durability, DURABILITY_NONE, DURABILITY_PERIODIC, DURABILITY_SYNC)
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("queue_size: can't be negative")
+	}
+	switch c.QueueFull {
+	case "", QUEUE_FULL_BLOCK, QUEUE_FULL_REJECT:
+	default:
+		return fmt.Errorf("queue_full: unknown mode %s, should be %s or %s", c.QueueFull, QUEUE_FULL_BLOCK, QUEUE_FULL_REJECT)
+	}
+	if c.Compression != "" {
+		if _, ok := compressions[c.Compression]; !ok {
+			return fmt.Errorf("compression: unknown compression %s, should be one of %s", c.Compression, strings.Join(compressionNames(), ", "))
+		}
+	}
+	if c.Type == SINK_TYPE_S3 {
+		if c.S3 == nil {
+			return fmt.Errorf("s3: required for s3 sinks")
+		}
+		if err := c.S3.validate(); err != nil {
+			return fmt.Errorf("s3.%v", err)
+		}
+	} else if c.S3 != nil {
+		return fmt.Errorf("s3: only used by s3 sinks")
+	}
+	if c.Type == SINK_TYPE_KAFKA {
+		if c.Kafka == nil {
+			return fmt.Errorf("kafka: required for kafka sinks")
+		}
+		if err := c.Kafka.validate(); err != nil {
+			return fmt.Errorf("kafka.%v", err)
+		}
+	} else if c.Kafka != nil {
+		return fmt.Errorf("kafka: only used by kafka sinks")
+	}
+	if c.Redis != nil {
+		if c.Type != SINK_TYPE_REDIS {
+			return fmt.Errorf("redis: only used by redis sinks")
+		}
+		if err := c.Redis.validate(); err != nil {
+			return fmt.Errorf("redis.%v", err)
+		}
+	}
+	if c.Type == SINK_TYPE_WEBHOOK {
+		if c.Webhook == nil {
+			return fmt.Errorf("webhook: required for webhook sinks")
+		}
+		if err := c.Webhook.validate(); err != nil {
+			return fmt.Errorf("webhook.%v", err)
+		}
+	} else if c.Webhook != nil {
+		return fmt.Errorf("webhook: only used by webhook sinks")
+	}
+	if c.SQLite != nil {
+		if c.Type != SINK_TYPE_SQLITE {
+			return fmt.Errorf("sqlite: only used by sqlite sinks")
+		}
+		if err := c.SQLite.validate(); err != nil {
+			return fmt.Errorf("sqlite.%v", err)
+		}
+	}
+	return nil
+}
+
+// sinkName is the name of the sink in metrics and errors
+func (c *EventStorageConfig) sinkName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.Type != "" {
+		return c.Type
+	}
+	return SINK_TYPE_FILE
+}
+
+// sinkField is the config field of the j-th sink, for errors
+func (c *EventTypeConfig) sinkField(j int) string {
+	if len(c.Sinks) == 0 {
+		return "storage"
+	}
+	return fmt.Sprintf("sinks[%d]", j)
+}
+
+func validateParamList(params []string) error {
+	for i, p := range params {
+		if p == "" {
+			return fmt.Errorf("empty param name")
+		}
+		if containsString(params[:i], p) {
+			return fmt.Errorf("duplicate param %s", p)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// newEventType creates the EventType without its Sink
+func (c *EventTypeConfig) newEventType() (EventType, error) {
+	e := NewEventType(c.Name)
+	if c.Stats != nil {
+		e.Stats = *c.Stats
+	}
+
+	schema, err := NewSchema(&c.Validation)
+	if err != nil {
+		return e, fmt.Errorf("%s: validation.%v", c.Name, err)
+	}
+	e.Schema = schema
+
+	return e, nil
+}
+
+// storageConfigs returns the settings of the sinks of the event type, merged with the global defaults
+func (c *EventTypeConfig) storageConfigs(defaults *StorageConfig) []*EventStorageConfig {
+	if len(c.Sinks) == 0 {
+		return []*EventStorageConfig{c.Storage.withDefaults(defaults)}
+	}
+	configs := make([]*EventStorageConfig, len(c.Sinks))
+	for i := range c.Sinks {
+		configs[i] = c.Sinks[i].withDefaults(defaults)
+	}
+	return configs
+}
+
+func (c EventStorageConfig) withDefaults(defaults *StorageConfig) *EventStorageConfig {
+	sc := c
+	if sc.Type == "" {
+		sc.Type = SINK_TYPE_FILE
+	}
+	sc.Name = sc.sinkName()
+	if sc.OnFailure == "" {
+		sc.OnFailure = ON_FAILURE_REJECT
+	}
+	if sc.DataDir == "" {
+		sc.DataDir = defaults.DataDir
+	}
+	if sc.Path == "" {
+		sc.Path = defaults.Path
+	}
+	if sc.Path == "" {
+		sc.Path = DEFAULT_PATH_TEMPLATE
+	}
+	if sc.Format == "" {
+		sc.Format = defaults.Format
+	}
+	if sc.Compression == "" {
+		sc.Compression = defaults.Compression
+	}
+	if sc.Partition == "" {
+		sc.Partition = defaults.Partition
+	}
+	if sc.MaxOpenFiles == 0 {
+		sc.MaxOpenFiles = defaults.MaxOpenFiles
+	}
+	if sc.IdleClose == 0 {
+		sc.IdleClose = Duration(defaults.IdleClose)
+	}
+	if sc.MaxBytes == 0 {
+		sc.MaxBytes = defaults.MaxBytes
+	}
+	if sc.MaxRecords == 0 {
+		sc.MaxRecords = defaults.MaxRecords
+	}
+	if sc.MaxAge == 0 {
+		sc.MaxAge = Duration(defaults.MaxAge)
+	}
+	if sc.Finalize == "" {
+		sc.Finalize = defaults.Finalize
+	}
+	if sc.Finalize == "" {
+		sc.Finalize = FINALIZE_NONE
+	}
+	if sc.Retention == 0 {
+		sc.Retention = Duration(defaults.Retention)
+	}
+	if sc.RetentionBytes == 0 {
+		sc.RetentionBytes = defaults.RetentionBytes
+	}
+	if sc.ArchiveDir == "" {
+		sc.ArchiveDir = defaults.ArchiveDir
+	}
+	if defaults.RetentionDryRun {
+		sc.RetentionDryRun = true
+	}
+	if sc.Durability == "" {
+		sc.Durability = defaults.Durability
+	}
+	if sc.Durability == "" {
+		sc.Durability = DURABILITY_NONE
+	}
+	if sc.SyncInterval == 0 {
+		sc.SyncInterval = Duration(defaults.SyncInterval)
+	}
+	if sc.SyncInterval == 0 && sc.Durability == DURABILITY_PERIODIC {
+		sc.SyncInterval = Duration(DEFAULT_SYNC_INTERVAL)
+	}
+	if sc.QueueSize == 0 {
+		sc.QueueSize = defaults.QueueSize
+	}
+	if sc.QueueSize == 0 {
+		sc.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if sc.QueueFull == "" {
+		sc.QueueFull = defaults.QueueFull
+	}
+	if sc.QueueFull == "" {
+		sc.QueueFull = QUEUE_FULL_BLOCK
+	}
+	if sc.QueueTimeout == 0 {
+		sc.QueueTimeout = Duration(defaults.QueueTimeout)
+	}
+	if sc.QueueTimeout == 0 {
+		sc.QueueTimeout = Duration(DEFAULT_QUEUE_TIMEOUT)
+	}
+	sc.redisPool = defaults.Redis
+	if sc.Type == SINK_TYPE_S3 {
+		// Closed files are uploaded, so they should be complete and closed in time
+		sc.Finalize = FINALIZE_RENAME
+		// Staged files are removed after they're uploaded
+		sc.Retention, sc.RetentionBytes, sc.ArchiveDir, sc.RetentionDryRun = 0, 0, "", false
+		if sc.IdleClose == 0 {
+			sc.IdleClose = Duration(DEFAULT_S3_IDLE_CLOSE)
+		}
+	}
+	if sc.Partition == PARTITION_EVENT { // Nothing set explicitly, use the defaults of the mode
+		if sc.MaxOpenFiles == 0 {
+			sc.MaxOpenFiles = DEFAULT_EVENT_PARTITION_MAX_OPEN_FILES
+		}
+		if sc.IdleClose == 0 {
+			sc.IdleClose = Duration(DEFAULT_EVENT_PARTITION_IDLE_CLOSE)
+		}
+	}
+	return &sc
+}
+
+// DefaultEventsConfig is used if no config file is given
+func DefaultEventsConfig(names []string) *EventsConfig {
+	c := &EventsConfig{
+		Events: make([]EventTypeConfig, len(names)),
+	}
+	for i, n := range names {
+		c.Events[i].Name = n
+	}
+	return c
+}
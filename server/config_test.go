@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestEventTypeConfigName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"link_clicked", true},
+		{"v1.click-2", true},
+		{"a..b", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"a/b", false},
+		{"batch", false},
+	}
+	for _, tt := range tests {
+		c := &EventTypeConfig{Name: tt.name}
+		if err := c.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate() of %q is %v, valid should be %v", tt.name, err, tt.valid)
+		}
+		s := &EventStorageConfig{Name: tt.name}
+		if err := s.validate(); tt.name != "" && tt.name != "batch" && (err == nil) != tt.valid {
+			t.Errorf("validate() of sink %q is %v, valid should be %v", tt.name, err, tt.valid)
+		}
+	}
+
+	for topic, valid := range map[string]bool{"{event}": true, "events.{event}": true, "..": false, ".{event}": false} {
+		c := &KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: topic}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("validate() of topic %q is %v, valid should be %v", topic, err, valid)
+		}
+	}
+
+	for deadLetter, valid := range map[string]bool{"": true, "deadletter/{event}.jsonl": true, "../x.jsonl": false, "a/../../x.jsonl": false, "./x.jsonl": false, "/tmp/x.jsonl": false, "x.ndjson": false, "x.tsv.gz.inprogress": false} {
+		c := &WebhookConfig{URL: "http://localhost/", DeadLetter: deadLetter}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("validate() of dead_letter %q is %v, valid should be %v", deadLetter, err, valid)
+		}
+	}
+
+	for database, valid := range map[string]bool{"": true, "events.db": true, "db/events.db": true, "../x.db": false, "db/../../x.db": false, "/tmp/x.db": false} {
+		c := &SQLiteConfig{Database: database}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("validate() of database %q is %v, valid should be %v", database, err, valid)
+		}
+	}
+
+	c := &EventStorageConfig{Type: SINK_TYPE_SQLITE}
+	if _, unavailable := unavailableSinks[SINK_TYPE_SQLITE]; (c.validate() == nil) == unavailable {
+		t.Errorf("validate() of a sqlite sink is %v, but the sink type is unavailable: %v", c.validate(), unavailable)
+	}
+}
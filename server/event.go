@@ -9,12 +9,17 @@ import (
 )
 
 type EventType struct {
-	Name    string
-	Storage *Storage
+	Name   string
+	Sink   Sink
+	Stats  bool    // Count events in Redis
+	Schema *Schema // Param validation rules, optional
+
+	storageConfigs []*EventStorageConfig // Settings the sinks were created with
+	spool          *Spool                // Events go through the spool to the Sink if it's set
 }
 
 func NewEventType(name string) EventType {
-	return EventType{Name: name}
+	return EventType{Name: name, Stats: true}
 }
 
 type EventRecord struct {
@@ -29,33 +34,65 @@ const (
 )
 
 func (s *Server) handleEvent(r *EventRecord) error {
-	t := s.getEventType(r)
+	countStats, err := s.storeEvent(r)
+	if err != nil {
+		return err
+	}
+
+	// TODO This can be launched in separate goroutine, or sent to a buffered channel and processed by a worker pool
+	// For now just count the event synchronously
+	if countStats {
+		s.Stats.CountEvent(r)
+	}
+
+	return nil
+}
+
+// storeEvent validates and enqueues the event. The registry can't be reloaded while this is running.
+func (s *Server) storeEvent(r *EventRecord) (countStats bool, err error) {
+	s.Config.Events.mu.RLock()
+	defer s.Config.Events.mu.RUnlock()
+
+	t := s.Config.Events.get(r.name)
 	if t == nil {
 		s.Logger.Debug("Invalid event", r)
-		return errors.New("Invalid event")
+		return false, errors.New("Invalid event")
 	}
 
 	s.Logger.Debug("Processing:", r)
 
+	if t.Schema != nil {
+		if err := t.Schema.Validate(r.data); err != nil {
+			s.Logger.Debugf("Invalid params for %s: %v", r, err)
+			return false, err
+		}
+	}
+
 	s.extractTimestamp(r)
 	s.Logger.Debug("Final form:", r)
 
-	t.Storage.Enqueue(r)
-
-	// TODO This can be launched in separate goroutine, or sent to a buffered channel and processed by a worker pool
-	// For now just count the event synchronously
-	s.Stats.CountEvent(r)
-
-	return nil
-}
+	if t.spool != nil {
+		// Accepted even if the sink is failing, it's delivered later
+		if err := t.spool.Append(r); err != nil {
+			s.Logger.Errorf("Could not spool %s: %v", r, err)
+			return false, &UnavailableError{Err: err}
+		}
+		return t.Stats, nil
+	}
 
-func (s *Server) getEventType(r *EventRecord) *EventType {
-	for _, t := range s.Config.EventTypes {
-		if t.Name == r.name {
-			return &t
+	if err := t.Sink.Health(); err != nil {
+		s.Logger.Debugf("Sink of %s is failing, rejecting %s", t.Name, r)
+		return false, &UnavailableError{Err: err}
+	}
+	if err := t.Sink.Enqueue(r); err != nil {
+		s.Logger.Errorf("Could not enqueue %s: %v", r, err)
+		if _, ok := err.(*UnavailableError); !ok {
+			err = &UnavailableError{Err: err}
 		}
+		return false, err
 	}
-	return nil
+
+	return t.Stats, nil
 }
 
 func (s *Server) extractTimestamp(r *EventRecord) error {
@@ -64,9 +101,19 @@ func (s *Server) extractTimestamp(r *EventRecord) error {
 
 	var ts int = 0
 	if r.data["ts"] != nil {
-		floatTs, err := strconv.ParseFloat(r.data["ts"].(string), 64) // allow for float input
+		// Query strings and form bodies give us a string, JSON bodies give us a number
+		var tsStr string
+		switch v := r.data["ts"].(type) {
+		case string:
+			tsStr = v
+		case json.Number:
+			tsStr = v.String()
+		default:
+			tsStr = fmt.Sprint(v)
+		}
+		floatTs, err := strconv.ParseFloat(tsStr, 64) // allow for float input
 		if err != nil {
-			s.Logger.Debugf("Invalid timestamp %s, will override", r.data["ts"].(string))
+			s.Logger.Debugf("Invalid timestamp %s, will override", tsStr)
 		}
 		ts = int(floatTs) // just chop it off
 	}
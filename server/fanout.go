@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alexcesaro/log"
+	"sync/atomic"
+)
+
+// What happens to an event if a sink can't accept it
+const (
+	ON_FAILURE_REJECT = "reject" // The event is rejected with the error of the sink (ie. 503), so the client retries it
+	ON_FAILURE_DROP   = "drop"   // The event is dropped for this sink only. The sink gets its own queue, so it can't slow down the others
+)
+
+// FanoutSink sends the events of an event type to all of its sinks
+type FanoutSink struct {
+	Name     string // Event type
+	Logger   log.Logger
+	branches []*sinkBranch
+}
+
+type sinkBranch struct {
+	accepted, rejected, dropped uint64 // Updated atomically, kept first for alignment
+	failing                     int32  // Set while a drop branch is dropping events, to log only the first one
+
+	name      string
+	sinkType  string
+	onFailure string
+	sink      Sink
+	queue     chan *EventRecord // ON_FAILURE_DROP only
+	done      chan struct{}
+}
+
+// SinkMetrics are the delivery counters of a sink since it was created
+type SinkMetrics struct {
+	Type     string       `json:"type"`
+	Status   string       `json:"status"`   // "ok" or the last error
+	Accepted uint64       `json:"accepted"` // Enqueued to the sink
+	Rejected uint64       `json:"rejected"` // Rejected by the sink, and so the event was rejected
+	Dropped  uint64       `json:"dropped"`  // Rejected by the sink (or its queue was full), but the event was accepted
+	Queue    *queueHealth `json:"queue,omitempty"`
+}
+
+type queueHealth struct {
+	Depth int `json:"depth"`
+	Size  int `json:"size"`
+}
+
+// NewFanoutSink creates the sinks of an event type. Sinks which were started are closed if one of them fails.
+func NewFanoutSink(e *EventType, configs []*EventStorageConfig, l log.Logger) (*FanoutSink, error) {
+	f := &FanoutSink{
+		Name:   e.Name,
+		Logger: l,
+	}
+	for _, c := range configs {
+		sink, err := NewSink(e, c, l)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("sink %s: %v", c.Name, err)
+		}
+
+		b := &sinkBranch{
+			name:      c.Name,
+			sinkType:  c.Type,
+			onFailure: c.OnFailure,
+			sink:      sink,
+		}
+		if b.onFailure == ON_FAILURE_DROP {
+			b.queue = make(chan *EventRecord, c.QueueSize)
+			b.done = make(chan struct{})
+			go f.runBranch(b)
+		}
+		f.branches = append(f.branches, b)
+	}
+	return f, nil
+}
+
+// Enqueue hands the record to all sinks. If a sink with ON_FAILURE_REJECT is failing, the record is rejected before any sink gets it.
+// If one fails while the record is enqueued (ie. its queue is full), the first error is returned, but the other sinks still get the record.
+func (f *FanoutSink) Enqueue(r *EventRecord) error {
+	// Otherwise the client's retry would be a duplicate in the sinks which accepted the record
+	for _, b := range f.branches {
+		if b.onFailure != ON_FAILURE_REJECT {
+			continue
+		}
+		if err := b.sink.Health(); err != nil {
+			atomic.AddUint64(&b.rejected, 1)
+			return &UnavailableError{Err: err}
+		}
+	}
+
+	var err error
+	for _, b := range f.branches {
+		if b.queue != nil {
+			select {
+			case b.queue <- r:
+			default:
+				f.drop(b, errQueueFull)
+			}
+			continue
+		}
+
+		if berr := b.sink.Enqueue(r); berr != nil {
+			atomic.AddUint64(&b.rejected, 1)
+			if err == nil {
+				err = berr
+			}
+			continue
+		}
+		atomic.AddUint64(&b.accepted, 1)
+	}
+	return err
+}
+
+// runBranch hands the records of an ON_FAILURE_DROP sink from its queue to the sink
+func (f *FanoutSink) runBranch(b *sinkBranch) {
+	for r := range b.queue {
+		if err := b.sink.Enqueue(r); err != nil {
+			f.drop(b, err)
+			continue
+		}
+		atomic.AddUint64(&b.accepted, 1)
+		if atomic.CompareAndSwapInt32(&b.failing, 1, 0) {
+			f.Logger.Infof("Sink %s of %s is accepting events again", b.name, f.Name)
+		}
+	}
+	close(b.done)
+}
+
+func (f *FanoutSink) drop(b *sinkBranch, err error) {
+	atomic.AddUint64(&b.dropped, 1)
+	if atomic.CompareAndSwapInt32(&b.failing, 0, 1) {
+		f.Logger.Errorf("Sink %s of %s is dropping events: %v", b.name, f.Name, err)
+	}
+}
+
+// Flush flushes all sinks. Records still in the queue of an ON_FAILURE_DROP sink are not waited for.
+func (f *FanoutSink) Flush() error {
+	var err error
+	for _, b := range f.branches {
+		berr := b.sink.Flush()
+		if berr != nil && b.onFailure == ON_FAILURE_REJECT && err == nil {
+			err = f.branchError(b, berr)
+		}
+	}
+	return err
+}
+
+// Close drains the queues and closes all sinks
+func (f *FanoutSink) Close() error {
+	var err error
+	for _, b := range f.branches {
+		if b.queue != nil {
+			close(b.queue)
+			<-b.done
+		}
+		if berr := b.sink.Close(); berr != nil && err == nil {
+			err = f.branchError(b, berr)
+		}
+	}
+	return err
+}
+
+// Health returns the error of the first failing ON_FAILURE_REJECT sink. Failing ON_FAILURE_DROP sinks are only reported in Metrics.
+func (f *FanoutSink) Health() error {
+	for _, b := range f.branches {
+		if b.onFailure != ON_FAILURE_REJECT {
+			continue
+		}
+		if err := b.sink.Health(); err != nil {
+			return f.branchError(b, err)
+		}
+	}
+	return nil
+}
+
+// branchError adds the name of the sink to errors, if there's more than one
+func (f *FanoutSink) branchError(b *sinkBranch, err error) error {
+	if len(f.branches) == 1 {
+		return err
+	}
+	return fmt.Errorf("%s: %v", b.name, err)
+}
+
+func (f *FanoutSink) Metrics() map[string]SinkMetrics {
+	m := make(map[string]SinkMetrics, len(f.branches))
+	for _, b := range f.branches {
+		sm := SinkMetrics{
+			Type:     b.sinkType,
+			Status:   "ok",
+			Accepted: atomic.LoadUint64(&b.accepted),
+			Rejected: atomic.LoadUint64(&b.rejected),
+			Dropped:  atomic.LoadUint64(&b.dropped),
+		}
+		if err := b.sink.Health(); err != nil {
+			sm.Status = err.Error()
+		}
+		if q, ok := b.sink.(QueueSink); ok {
+			depth, size := q.QueueDepth()
+			sm.Queue = &queueHealth{depth, size}
+		}
+		if b.queue != nil {
+			if sm.Queue == nil {
+				sm.Queue = &queueHealth{}
+			}
+			sm.Queue.Depth += len(b.queue)
+			sm.Queue.Size += cap(b.queue)
+		}
+		m[b.name] = sm
+	}
+	return m
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	STORAGE_FORMAT_TSV     = "tsv"
+	STORAGE_FORMAT_NDJSON  = "ndjson"
+	STORAGE_FORMAT_PARQUET = "parquet"
+)
+
+// recordWriter writes records to an open file in a storage format
+type recordWriter interface {
+	Write(r *EventRecord) error
+	// Flush writes buffered data to the underlying writer
+	Flush() error
+	// Close finalizes the file format. It doesn't close the underlying writer.
+	Close() error
+}
+
+type storageFormat struct {
+	ext            string // File extension
+	newWriter      func(w io.Writer, schema *Schema, compression string) recordWriter
+	appendable     bool // Can records be appended to an existing file
+	usesSchema     bool // Does the file layout depend on the declared params of the event type
+	ownCompression bool // Does the format handle compression itself, instead of compressing the whole file
+}
+
+var storageFormats = map[string]storageFormat{
+	STORAGE_FORMAT_TSV:     {"tsv", newTSVWriter, true, false, false},
+	STORAGE_FORMAT_NDJSON:  {"ndjson", newNDJSONWriter, true, false, false},
+	STORAGE_FORMAT_PARQUET: {"parquet", newParquetWriter, false, true, true},
+}
+
+func IsValidStorageFormat(name string) bool {
+	_, ok := storageFormats[name]
+	return ok
+}
+
+func storageFormatNames() []string {
+	names := make([]string, 0, len(storageFormats))
+	for n := range storageFormats {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tsvWriter writes TSV with embedded JSON: received timestamp in nanoseconds, JSON data
+type tsvWriter struct {
+	cw *csv.Writer
+}
+
+func newTSVWriter(w io.Writer, _ *Schema, _ string) recordWriter {
+	cw := csv.NewWriter(w)
+	cw.Comma = '\t' // Create TSV
+	return &tsvWriter{cw}
+}
+
+func (t *tsvWriter) Write(r *EventRecord) error {
+	jsonData, err := json.Marshal(r.data)
+	if err != nil {
+		return err
+	}
+
+	return t.cw.Write([]string{
+		strconv.FormatInt(r.tsReceived, 10), // timestamp
+		string(jsonData),                    // json data
+	})
+}
+
+func (t *tsvWriter) Flush() error {
+	t.cw.Flush()
+	return t.cw.Error()
+}
+
+func (t *tsvWriter) Close() error {
+	return t.Flush()
+}
+
+// ndjsonWriter writes one JSON object per line, without any escaping other than JSON's own
+type ndjsonWriter struct {
+	bw *bufio.Writer
+}
+
+type ndjsonRecord struct {
+	Received int64                  `json:"received"` // Received timestamp in nanoseconds
+	Event    string                 `json:"event"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+func newNDJSONWriter(w io.Writer, _ *Schema, _ string) recordWriter {
+	return &ndjsonWriter{bufio.NewWriter(w)}
+}
+
+func (n *ndjsonWriter) Write(r *EventRecord) error {
+	jsonData, err := json.Marshal(&ndjsonRecord{
+		Received: r.tsReceived,
+		Event:    r.name,
+		Data:     r.data,
+	})
+	if err != nil {
+		return err
+	}
+
+	jsonData = append(jsonData, '\n')
+	_, err = n.bw.Write(jsonData)
+	return err
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return n.bw.Flush()
+}
+
+func (n *ndjsonWriter) Close() error {
+	return n.Flush()
+}
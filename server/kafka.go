@@ -0,0 +1,623 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal Kafka producer: Metadata v4 and Produce v3 (v7 for zstd) with record batches (magic 2), so Kafka 0.11+ (2.1+ for zstd).
+// No TLS, SASL, idempotence or transactions.
+
+const (
+	KAFKA_ACKS_NONE   = "none"   // Don't wait for the broker, errors are not detected
+	KAFKA_ACKS_LEADER = "leader" // The leader has written the records
+	KAFKA_ACKS_ALL    = "all"    // All in-sync replicas have the records
+)
+
+const (
+	DEFAULT_KAFKA_TOPIC      = "{event}"
+	DEFAULT_KAFKA_BATCH_SIZE = 1000
+	DEFAULT_KAFKA_LINGER     = 100 * time.Millisecond
+	DEFAULT_KAFKA_TIMEOUT    = 10 * time.Second
+	KAFKA_CLIENT_ID          = "data-api-server"
+)
+
+const (
+	kafkaApiProduce  = 0
+	kafkaApiMetadata = 3
+)
+
+var kafkaTopicRegexp = eventNameRegexp // Same characters
+
+// KafkaConfig is the destination of a kafka sink
+type KafkaConfig struct {
+	Brokers   []string `json:"brokers" yaml:"brokers"`       // Bootstrap brokers, host:port
+	Topic     string   `json:"topic" yaml:"topic"`           // {event} is replaced with the event type
+	Key       string   `json:"key" yaml:"key"`               // Param used as the message key, so that events with the same value go to the same partition. Without it, batches are spread over the partitions.
+	Acks      string   `json:"acks" yaml:"acks"`             // One of the KAFKA_ACKS_ constants
+	BatchSize int      `json:"batch_size" yaml:"batch_size"` // Max records in a produce request
+	Linger    Duration `json:"linger" yaml:"linger"`         // How long to wait for a batch to fill up
+	Timeout   Duration `json:"timeout" yaml:"timeout"`       // Of connections and requests
+}
+
+func (c *KafkaConfig) validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("brokers: can't be empty")
+	}
+	for _, b := range c.Brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return fmt.Errorf("brokers: %v", err)
+		}
+	}
+	if c.Topic != "" && !kafkaTopicRegexp.MatchString(strings.Replace(c.Topic, "{event}", "event", -1)) {
+		return fmt.Errorf("topic: should only contain letters, digits, '_', '.', '-' and {event}, and not start with '.'")
+	}
+	switch c.Acks {
+	case "", KAFKA_ACKS_NONE, KAFKA_ACKS_LEADER, KAFKA_ACKS_ALL:
+	default:
+		return fmt.Errorf("acks: unknown level %s, should be %s, %s or %s", c.Acks, KAFKA_ACKS_NONE, KAFKA_ACKS_LEADER, KAFKA_ACKS_ALL)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size: can't be negative")
+	}
+	return nil
+}
+
+// kafkaError is an error code returned by the broker
+type kafkaError int16
+
+var kafkaErrorNames = map[kafkaError]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	17: "INVALID_TOPIC_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	76: "UNSUPPORTED_COMPRESSION_TYPE",
+	87: "INVALID_RECORD",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return "Kafka error " + name
+	}
+	return fmt.Sprintf("Kafka error %d", int16(e))
+}
+
+// permanent errors won't go away by retrying the same records
+func (e kafkaError) permanent() bool {
+	return e == 10 || e == 18 || e == 87
+}
+
+// kafkaEncoder builds requests
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// kafkaDecoder reads responses. The first error is kept, and makes the rest of the reads return zeros.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+var errKafkaShortResponse = errors.New("Kafka response is too short")
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errKafkaShortResponse
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// kafkaConn is a connection to a broker. Requests are sent one at a time.
+type kafkaConn struct {
+	conn          net.Conn
+	timeout       time.Duration
+	correlationID int32
+}
+
+func dialKafka(addr string, timeout time.Duration) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, timeout: timeout}, nil
+}
+
+// request sends the request, and returns the response body after the header. There's no response to a produce request with acks 0.
+func (c *kafkaConn) request(apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	c.correlationID++
+	var e kafkaEncoder
+	e.int32(0) // Size
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(c.correlationID)
+	e.string(KAFKA_CLIENT_ID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(e.b); err != nil {
+		return nil, err
+	}
+	if !response {
+		return nil, nil
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != c.correlationID {
+		return nil, errors.New("Kafka response doesn't match the request")
+	}
+	return resp[4:], nil
+}
+
+// kafkaMessage is a record to be produced
+type kafkaMessage struct {
+	key   []byte // nil for no key
+	value []byte
+	ts    int64 // Milliseconds
+}
+
+// kafkaProducer sends messages to a topic. Not safe for concurrent use.
+type kafkaProducer struct {
+	bootstrap   []string
+	topic       string
+	acks        int16
+	timeout     time.Duration
+	compression string // One of the COMPRESSION_ constants
+
+	brokers map[int32]string // Addresses by node id
+	leaders []int32          // By partition, nil if the metadata should be fetched
+	conns   map[string]*kafkaConn
+	next    int // Partition of the next batch of messages without a key
+}
+
+func newKafkaProducer(c *KafkaConfig, topic, compression string) *kafkaProducer {
+	p := &kafkaProducer{
+		bootstrap:   c.Brokers,
+		topic:       topic,
+		acks:        -1,
+		timeout:     time.Duration(c.Timeout),
+		compression: compression,
+		conns:       make(map[string]*kafkaConn),
+	}
+	switch c.Acks {
+	case KAFKA_ACKS_NONE:
+		p.acks = 0
+	case KAFKA_ACKS_LEADER:
+		p.acks = 1
+	}
+	if p.timeout <= 0 {
+		p.timeout = DEFAULT_KAFKA_TIMEOUT
+	}
+	return p
+}
+
+func (p *kafkaProducer) conn(addr string) (*kafkaConn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+	c, err := dialKafka(addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = c
+	return c, nil
+}
+
+func (p *kafkaProducer) closeConn(addr string) {
+	if c, ok := p.conns[addr]; ok {
+		c.conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+func (p *kafkaProducer) close() {
+	for addr := range p.conns {
+		p.closeConn(addr)
+	}
+}
+
+// refreshMetadata gets the partition leaders of the topic from any broker, known ones first
+func (p *kafkaProducer) refreshMetadata() error {
+	addrs := make([]string, 0, len(p.brokers)+len(p.bootstrap))
+	for _, addr := range p.brokers {
+		addrs = append(addrs, addr)
+	}
+	addrs = append(addrs, p.bootstrap...)
+
+	var e kafkaEncoder
+	e.int32(1)
+	e.string(p.topic)
+	e.int8(1) // allow_auto_topic_creation, if the broker allows it
+
+	var err error
+	for _, addr := range addrs {
+		var c *kafkaConn
+		var resp []byte
+		if c, err = p.conn(addr); err != nil {
+			continue
+		}
+		if resp, err = c.request(kafkaApiMetadata, 4, e.b, true); err != nil {
+			p.closeConn(addr)
+			continue
+		}
+		return p.parseMetadata(resp)
+	}
+	return fmt.Errorf("Could not get metadata from any broker: %v", err)
+}
+
+func (p *kafkaProducer) parseMetadata(resp []byte) error {
+	d := &kafkaDecoder{b: resp}
+	d.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+
+	var leaders []int32
+	var topicErr error
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.next(1) // is_internal
+		var partitions []int32
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int16() // Partition error, ie. no leader at the moment
+			index := d.int32()
+			leader := d.int32()
+			d.next(4 * int(d.int32())) // replica_nodes
+			d.next(4 * int(d.int32())) // isr_nodes
+			for int(index) >= len(partitions) {
+				partitions = append(partitions, -1)
+			}
+			partitions[index] = leader
+		}
+		if name != p.topic {
+			continue
+		}
+		if code != 0 {
+			topicErr = kafkaError(code)
+		}
+		leaders = partitions
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if topicErr != nil {
+		return topicErr
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("Topic %s has no partitions", p.topic)
+	}
+	p.brokers = brokers
+	p.leaders = leaders
+	return nil
+}
+
+// produce sends the messages to the leaders of their partitions. Messages which failed are returned with the first error.
+// Messages which can't ever be written (ie. too large) are dropped, and returned as dropped.
+func (p *kafkaProducer) produce(msgs []kafkaMessage) (failed []kafkaMessage, dropped int, err error) {
+	if p.leaders == nil {
+		if err := p.refreshMetadata(); err != nil {
+			return msgs, 0, err
+		}
+	}
+
+	// Leader -> partition -> messages
+	byLeader := make(map[int32]map[int32][]kafkaMessage)
+	n := int32(len(p.leaders))
+	sticky := int32(p.next % len(p.leaders))
+	p.next++
+	for _, m := range msgs {
+		partition := sticky
+		if m.key != nil {
+			partition = (murmur2(m.key) & 0x7fffffff) % n
+		}
+		leader := p.leaders[partition]
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[int32][]kafkaMessage)
+		}
+		byLeader[leader][partition] = append(byLeader[leader][partition], m)
+	}
+
+	fail := func(ms []kafkaMessage, e error) {
+		failed = append(failed, ms...)
+		if err == nil {
+			err = e
+		}
+		p.leaders = nil // Get the leaders again before the retry
+	}
+
+	for leader, partitions := range byLeader {
+		addr, ok := p.brokers[leader]
+		if !ok {
+			for _, ms := range partitions {
+				fail(ms, kafkaError(5)) // LEADER_NOT_AVAILABLE
+			}
+			continue
+		}
+
+		f, d, perr := p.produceTo(addr, partitions)
+		dropped += d
+		for _, partition := range f {
+			fail(partitions[partition], perr)
+		}
+	}
+	return failed, dropped, err
+}
+
+// produceTo sends one request to a broker. Returns the partitions which failed with the first error.
+func (p *kafkaProducer) produceTo(addr string, partitions map[int32][]kafkaMessage) (failed []int32, dropped int, err error) {
+	all := func(e error) ([]int32, int, error) {
+		for partition := range partitions {
+			failed = append(failed, partition)
+		}
+		return failed, 0, e
+	}
+
+	version := int16(3)
+	if p.compression == COMPRESSION_ZSTD {
+		version = 7
+	}
+
+	var e kafkaEncoder
+	e.nullString() // transactional_id
+	e.int16(p.acks)
+	e.int32(int32(p.timeout / time.Millisecond))
+	e.int32(1)
+	e.string(p.topic)
+	e.int32(int32(len(partitions)))
+	for partition, ms := range partitions {
+		batch, err := kafkaRecordBatch(ms, p.compression)
+		if err != nil {
+			return all(err)
+		}
+		e.int32(partition)
+		e.bytes(batch)
+	}
+
+	c, err := p.conn(addr)
+	if err != nil {
+		return all(err)
+	}
+	resp, err := c.request(kafkaApiProduce, version, e.b, p.acks != 0)
+	if err != nil {
+		p.closeConn(addr)
+		return all(err)
+	}
+	if p.acks == 0 {
+		return nil, 0, nil
+	}
+
+	d := &kafkaDecoder{b: resp}
+	results := make(map[int32]kafkaError, len(partitions))
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string() // topic
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			partition := d.int32()
+			results[partition] = kafkaError(d.int16())
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+			if version >= 5 {
+				d.int64() // log_start_offset
+			}
+		}
+	}
+	if d.err != nil {
+		p.closeConn(addr)
+		return all(d.err)
+	}
+
+	for partition, ms := range partitions {
+		code, ok := results[partition]
+		switch {
+		case !ok:
+			failed = append(failed, partition)
+			if err == nil {
+				err = errors.New("Kafka response is missing a partition")
+			}
+		case code == 0:
+		case code.permanent():
+			dropped += len(ms)
+		default:
+			failed = append(failed, partition)
+			if err == nil {
+				err = code
+			}
+		}
+	}
+	return failed, dropped, err
+}
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch encodes the messages as a record batch (magic 2), compressed as a whole
+func kafkaRecordBatch(msgs []kafkaMessage, compression string) ([]byte, error) {
+	first, max := msgs[0].ts, msgs[0].ts
+	var records, r kafkaEncoder
+	for i, m := range msgs {
+		if m.ts > max {
+			max = m.ts
+		}
+		r.b = r.b[:0]
+		r.int8(0) // attributes
+		r.varint(m.ts - first)
+		r.varint(int64(i))
+		if m.key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(m.key)))
+			r.b = append(r.b, m.key...)
+		}
+		r.varint(int64(len(m.value)))
+		r.b = append(r.b, m.value...)
+		r.varint(0) // headers
+		records.varint(int64(len(r.b)))
+		records.b = append(records.b, r.b...)
+	}
+
+	var attributes int16
+	switch compression {
+	case COMPRESSION_GZIP:
+		attributes = 1
+	case COMPRESSION_ZSTD:
+		attributes = 4
+	}
+	data, err := compressBlock(compression, records.b)
+	if err != nil {
+		return nil, err
+	}
+
+	var b kafkaEncoder
+	b.int64(0)  // base_offset
+	b.int32(0)  // batch_length, set below
+	b.int32(-1) // partition_leader_epoch
+	b.int8(2)   // magic
+	b.int32(0)  // crc, set below
+	b.int16(attributes)
+	b.int32(int32(len(msgs) - 1)) // last_offset_delta
+	b.int64(first)
+	b.int64(max)
+	b.int64(-1) // producer_id
+	b.int16(-1) // producer_epoch
+	b.int32(-1) // base_sequence
+	b.int32(int32(len(msgs)))
+	b.b = append(b.b, data...)
+
+	binary.BigEndian.PutUint32(b.b[8:], uint32(len(b.b)-12))
+	binary.BigEndian.PutUint32(b.b[17:], crc32.Checksum(b.b[21:], kafkaCRCTable))
+	return b.b, nil
+}
+
+// murmur2 is the hash of the default partitioner of the Java client, so keys go to the same partitions as with other producers
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
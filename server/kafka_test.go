@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// crc32c is a bitwise CRC-32C, to check the table driven one
+func crc32c(b []byte) uint32 {
+	c := ^uint32(0)
+	for _, x := range b {
+		c ^= uint32(x)
+		for i := 0; i < 8; i++ {
+			if c&1 == 1 {
+				c = c>>1 ^ 0x82f63b78
+			} else {
+				c >>= 1
+			}
+		}
+	}
+	return ^c
+}
+
+func TestKafkaVarint(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want string
+	}{
+		{0, "00"},
+		{-1, "01"},
+		{1, "02"},
+		{63, "7e"},
+		{-64, "7f"},
+		{64, "8001"},
+		{-65, "8101"},
+		{300, "d804"},
+		{-300, "d704"},
+	}
+	for _, tt := range tests {
+		var e kafkaEncoder
+		e.varint(tt.v)
+		if got := hex.EncodeToString(e.b); got != tt.want {
+			t.Errorf("varint(%d) is %s, should be %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	b, err := kafkaRecordBatch([]kafkaMessage{{key: []byte("k"), value: []byte("v"), ts: 1000}}, COMPRESSION_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0000000000000000" + // base_offset
+		"0000003a" + // batch_length
+		"ffffffff" + // partition_leader_epoch
+		"02" + // magic
+		"716a6189" + // crc
+		"0000" + // attributes
+		"00000000" + // last_offset_delta
+		"00000000000003e8" + // first_timestamp
+		"00000000000003e8" + // max_timestamp
+		"ffffffffffffffff" + // producer_id
+		"ffff" + // producer_epoch
+		"ffffffff" + // base_sequence
+		"00000001" + // records
+		"10" + "00" + "00" + "00" + "026b" + "0276" + "00" // length, attributes, timestamp_delta, offset_delta, key, value, headers
+	if got := hex.EncodeToString(b); got != want {
+		t.Errorf("record batch is\n%s, should be\n%s", got, want)
+	}
+	if crc := crc32c([]byte("123456789")); crc != 0xe3069283 {
+		t.Fatalf("CRC-32C of the check string is %08x, should be e3069283", crc)
+	}
+}
+
+func TestKafkaRecordBatchCompressed(t *testing.T) {
+	msgs := []kafkaMessage{
+		{key: []byte("key"), value: []byte("first"), ts: 1500000000000},
+		{value: bytes.Repeat([]byte("x"), 200), ts: 1500000000100}, // No key, and a length of 2 bytes
+		{key: []byte{}, value: []byte("earlier"), ts: 1499999999000},
+	}
+
+	for _, tt := range []struct {
+		compression string
+		attributes  int16
+	}{
+		{COMPRESSION_NONE, 0},
+		{COMPRESSION_GZIP, 1},
+		{COMPRESSION_ZSTD, 4},
+	} {
+		t.Run(tt.compression, func(t *testing.T) {
+			b, err := kafkaRecordBatch(msgs, tt.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &kafkaDecoder{b: b}
+			d.int64()
+			if n := d.int32(); int(n) != len(b)-12 {
+				t.Errorf("batch_length is %d, should be %d", n, len(b)-12)
+			}
+			d.int32()
+			if magic := d.next(1); magic[0] != 2 {
+				t.Errorf("magic is %d, should be 2", magic[0])
+			}
+			if crc := uint32(d.int32()); crc != crc32c(b[21:]) {
+				t.Errorf("crc is %08x, should be %08x", crc, crc32c(b[21:]))
+			}
+			if a := d.int16(); a != tt.attributes {
+				t.Errorf("attributes are %d, should be %d", a, tt.attributes)
+			}
+			if n := d.int32(); n != 2 {
+				t.Errorf("last_offset_delta is %d, should be 2", n)
+			}
+			first, max := d.int64(), d.int64()
+			if first != msgs[0].ts || max != msgs[1].ts {
+				t.Errorf("timestamps are %d to %d, should be %d to %d", first, max, msgs[0].ts, msgs[1].ts)
+			}
+			d.next(14)
+			if n := d.int32(); n != 3 {
+				t.Errorf("%d records, should be 3", n)
+			}
+			if d.err != nil {
+				t.Fatal(d.err)
+			}
+
+			data := d.b
+			if newReader := compressions[tt.compression].newReader; newReader != nil {
+				r, err := newReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, err = ioutil.ReadAll(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			varint := func() int64 {
+				v, n := binary.Varint(data)
+				if n <= 0 {
+					t.Fatalf("invalid varint in %x", data)
+				}
+				data = data[n:]
+				return v
+			}
+			bytesField := func() []byte {
+				n := varint()
+				if n < 0 {
+					return nil
+				}
+				v := data[:n]
+				data = data[n:]
+				return v
+			}
+			var got []kafkaMessage
+			for i := 0; len(data) > 0; i++ {
+				length := varint()
+				rest := len(data) - int(length)
+				data = data[1:] // attributes
+				m := kafkaMessage{ts: first + varint()}
+				if delta := varint(); delta != int64(i) {
+					t.Errorf("offset_delta of record %d is %d", i, delta)
+				}
+				m.key, m.value = bytesField(), bytesField()
+				if h := varint(); h != 0 {
+					t.Errorf("record %d has %d headers", i, h)
+				}
+				if len(data) != rest {
+					t.Fatalf("record %d is %d bytes, its length is %d", i, int(length)+rest-len(data), length)
+				}
+				got = append(got, m)
+			}
+			if !reflect.DeepEqual(got, msgs) {
+				t.Errorf("records are %+v, should be %+v", got, msgs)
+			}
+		})
+	}
+}
+
+// Test vectors of the Java client
+func TestMurmur2(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+	for _, tt := range tests {
+		if got := murmur2([]byte(tt.s)); got != tt.want {
+			t.Errorf("murmur2(%q) is %d, should be %d", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexcesaro/log"
+	"strings"
+	"time"
+)
+
+const SINK_TYPE_KAFKA = "kafka"
+
+func init() {
+	RegisterSink(SINK_TYPE_KAFKA, newKafkaSink)
+}
+
+// KafkaSink produces each record as a JSON message (like a line of the ndjson format) to a Kafka topic.
+// Records are batched by a worker, which retries failed batches with a backoff. While it's failing, events are rejected like with a failing Storage.
+type KafkaSink struct {
+	Name     string // Event type
+	Config   KafkaConfig
+	Logger   log.Logger
+	queue    *sinkQueue
+	producer *kafkaProducer
+	done     chan struct{}
+}
+
+func newKafkaSink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	kc := *c.Kafka
+	if kc.Topic == "" {
+		kc.Topic = DEFAULT_KAFKA_TOPIC
+	}
+	kc.Topic = strings.Replace(kc.Topic, "{event}", e.Name, -1)
+	if kc.Acks == "" {
+		kc.Acks = KAFKA_ACKS_ALL
+	}
+	if kc.BatchSize == 0 {
+		kc.BatchSize = DEFAULT_KAFKA_BATCH_SIZE
+	}
+	if kc.Linger == 0 {
+		kc.Linger = Duration(DEFAULT_KAFKA_LINGER)
+	}
+	if kc.Timeout == 0 {
+		kc.Timeout = Duration(DEFAULT_KAFKA_TIMEOUT)
+	}
+
+	s := &KafkaSink{
+		Name:     e.Name,
+		Config:   kc,
+		Logger:   l,
+		queue:    newSinkQueue(c),
+		producer: newKafkaProducer(&kc, kc.Topic, c.Compression),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *KafkaSink) run() {
+	defer close(s.done)
+	defer s.producer.close()
+	s.queue.run(s.Config.BatchSize, time.Duration(s.Config.Linger), s.send)
+}
+
+// send produces the records, retrying the ones which failed until they're written or the sink is closed
+func (s *KafkaSink) send(records []*EventRecord) error {
+	batch := make([]kafkaMessage, 0, len(records))
+	for _, r := range records {
+		m, err := s.message(r)
+		if err != nil {
+			s.Logger.Errorf("Could not encode %s: %v", r, err)
+			continue
+		}
+		batch = append(batch, m)
+	}
+
+	err := s.queue.retry("Producing to "+s.Config.Topic, s.Logger, func() error {
+		failed, dropped, err := s.producer.produce(batch)
+		if dropped > 0 {
+			s.Logger.Errorf("Kafka rejected %d records of %s, dropping them", dropped, s.Config.Topic)
+		}
+		batch = failed
+		return err
+	})
+	if err != nil {
+		s.Logger.Errorf("Lost %d records of %s", len(batch), s.Config.Topic)
+	}
+	return err
+}
+
+func (s *KafkaSink) message(r *EventRecord) (kafkaMessage, error) {
+	value, err := json.Marshal(&ndjsonRecord{
+		Received: r.tsReceived,
+		Event:    r.name,
+		Data:     r.data,
+	})
+	if err != nil {
+		return kafkaMessage{}, err
+	}
+
+	m := kafkaMessage{
+		value: value,
+		ts:    r.tsReceived / int64(time.Millisecond),
+	}
+	if s.Config.Key != "" {
+		if v, ok := r.data[s.Config.Key]; ok && v != nil {
+			m.key = []byte(fmt.Sprint(v))
+		}
+	}
+	return m, nil
+}
+
+func (s *KafkaSink) Enqueue(r *EventRecord) error {
+	return s.queue.enqueue(r)
+}
+
+// Flush sends the queued records, and returns after they were sent (and acknowledged, unless acks is none)
+func (s *KafkaSink) Flush() error {
+	return s.queue.flush()
+}
+
+// Close sends the rest of the queue, trying once if Kafka is failing
+func (s *KafkaSink) Close() error {
+	s.queue.close()
+	<-s.done
+	return s.queue.health()
+}
+
+func (s *KafkaSink) Health() error {
+	return s.queue.health()
+}
+
+func (s *KafkaSink) QueueDepth() (depth, size int) {
+	return s.queue.QueueDepth()
+}
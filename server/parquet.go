@@ -0,0 +1,630 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// A minimal Parquet writer: PLAIN encoding, one data page per column chunk, flat schema, optional gzip or zstd page compression.
+// Records are buffered in memory and written as a row group on Flush, when PARQUET_ROW_GROUP_SIZE is reached, or on Close, which also writes the footer.
+// See https://github.com/apache/parquet-format for the format.
+
+const PARQUET_ROW_GROUP_SIZE = 100000 // Rows
+
+const PARQUET_EXTRA_COLUMN = "extra"
+
+const parquetMagic = "PAR1"
+
+// Physical types
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Repetition types
+const (
+	parquetRequired = 0
+	parquetOptional = 1
+)
+
+// Converted types
+const (
+	parquetConvertedUTF8 = 0
+	parquetConvertedJSON = 19
+)
+
+// Encodings
+const (
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+)
+
+// Compression codecs
+const (
+	parquetCodecUncompressed = 0
+	parquetCodecGzip         = 2
+	parquetCodecZstd         = 6
+)
+
+const parquetPageTypeData = 0
+
+type parquetColumn struct {
+	name      string
+	physType  int32
+	optional  bool
+	converted int32 // -1 for none
+	logical   func(t *thriftWriter)
+
+	defLevels []bool // For optional columns, whether the value is present
+	ints      []int64
+	floats    []float64
+	bools     []bool
+	binaries  [][]byte
+}
+
+type parquetWriter struct {
+	w           *countingWriter
+	compression string // Page compression, one of the COMPRESSION_ constants
+	columns     []*parquetColumn
+	params      map[string]*parquetColumn // Columns of declared params
+	extra       *parquetColumn
+	rows        int
+	totalRows   int64
+	rowGroups   [][]parquetChunk
+	started     bool
+}
+
+// Metadata of a written column chunk
+type parquetChunk struct {
+	column           *parquetColumn
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newParquetWriter derives the columns from the declared params of the event type:
+//
+//	received: received timestamp in nanoseconds
+//	ts: event timestamp in seconds
+//	<param>: one optional column for each param with rules, multiple params are stored as JSON arrays
+//	extra: JSON object of the rest of the params, null if there are none
+func newParquetWriter(w io.Writer, schema *Schema, compression string) recordWriter {
+	p := &parquetWriter{
+		w:           &countingWriter{w: w},
+		compression: compression,
+		params:      make(map[string]*parquetColumn),
+	}
+
+	p.columns = append(p.columns, &parquetColumn{
+		name:      "received",
+		physType:  parquetInt64,
+		converted: -1,
+		logical: func(t *thriftWriter) {
+			t.structBegin(8) // TIMESTAMP
+			t.boolField(1, true)
+			t.structBegin(2)
+			t.structBegin(3) // NANOS
+			t.structEnd()
+			t.structEnd()
+			t.structEnd()
+		},
+	}, &parquetColumn{
+		name:      "ts",
+		physType:  parquetInt64,
+		converted: -1,
+	})
+
+	var names []string
+	if schema != nil {
+		for n := range schema.Params {
+			if n != PARQUET_EXTRA_COLUMN && n != "received" {
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		rule := schema.Params[n]
+		c := &parquetColumn{
+			name:      n,
+			optional:  true,
+			converted: -1,
+		}
+		switch {
+		case rule.Multiple:
+			c.physType, c.converted = parquetByteArray, parquetConvertedJSON
+		case rule.Type == PARAM_TYPE_INT:
+			c.physType = parquetInt64
+		case rule.Type == PARAM_TYPE_FLOAT:
+			c.physType = parquetDouble
+		case rule.Type == PARAM_TYPE_BOOL:
+			c.physType = parquetBoolean
+		default:
+			c.physType, c.converted = parquetByteArray, parquetConvertedUTF8
+		}
+		p.columns = append(p.columns, c)
+		p.params[n] = c
+	}
+
+	p.extra = &parquetColumn{
+		name:      PARQUET_EXTRA_COLUMN,
+		physType:  parquetByteArray,
+		optional:  true,
+		converted: parquetConvertedJSON,
+	}
+	p.columns = append(p.columns, p.extra)
+
+	return p
+}
+
+func (p *parquetWriter) Write(r *EventRecord) error {
+	if err := p.columns[1].appendValue(r.data["ts"]); err != nil {
+		return err
+	}
+	p.columns[0].appendValue(r.tsReceived)
+
+	var extra map[string]interface{}
+	for k, v := range r.data {
+		if k == "ts" || p.params[k] != nil {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[k] = v
+	}
+
+	for _, c := range p.columns[2:] {
+		if c == p.extra {
+			break
+		}
+		v, ok := r.data[c.name]
+		if !ok {
+			c.appendNull()
+			continue
+		}
+		if err := c.appendValue(v); err != nil {
+			return err
+		}
+	}
+
+	if extra == nil {
+		p.extra.appendNull()
+	} else if err := p.extra.appendValue(extra); err != nil {
+		return err
+	}
+
+	p.rows++
+	if p.rows >= PARQUET_ROW_GROUP_SIZE {
+		return p.writeRowGroup()
+	}
+	return nil
+}
+
+func (c *parquetColumn) appendNull() {
+	c.defLevels = append(c.defLevels, false)
+}
+
+// appendValue appends a value which passed validation, so it's already converted to the declared type.
+// A value of another type (ie. stored before the param was declared) is appended as null if the column is optional, or is an error.
+func (c *parquetColumn) appendValue(v interface{}) error {
+	var jsonData []byte
+	ok := true
+	if c.converted == parquetConvertedJSON {
+		var err error
+		if jsonData, err = json.Marshal(v); err != nil {
+			return err
+		}
+	} else {
+		switch c.physType {
+		case parquetInt64:
+			switch v.(type) {
+			case int64, int:
+			default:
+				ok = false
+			}
+		case parquetDouble:
+			_, ok = v.(float64)
+		case parquetBoolean:
+			_, ok = v.(bool)
+		case parquetByteArray:
+			_, ok = v.(string)
+		}
+	}
+	if !ok {
+		if c.optional {
+			c.appendNull()
+			return nil
+		}
+		return fmt.Errorf("Column %s can't have the %T value %v", c.name, v, v)
+	}
+
+	if c.optional {
+		c.defLevels = append(c.defLevels, true)
+	}
+	if jsonData != nil {
+		c.binaries = append(c.binaries, jsonData)
+		return nil
+	}
+	switch vv := v.(type) {
+	case int64:
+		c.ints = append(c.ints, vv)
+	case int:
+		c.ints = append(c.ints, int64(vv))
+	case float64:
+		c.floats = append(c.floats, vv)
+	case bool:
+		c.bools = append(c.bools, vv)
+	case string:
+		c.binaries = append(c.binaries, []byte(vv))
+	}
+	return nil
+}
+
+func (c *parquetColumn) reset() {
+	c.defLevels = c.defLevels[:0]
+	c.ints = c.ints[:0]
+	c.floats = c.floats[:0]
+	c.bools = c.bools[:0]
+	c.binaries = c.binaries[:0]
+}
+
+// Flush writes the buffered records as a row group
+func (p *parquetWriter) Flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+	return p.writeRowGroup()
+}
+
+// Close writes the buffered records and the footer
+func (p *parquetWriter) Close() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	if err := p.writeMagic(); err != nil {
+		return err
+	}
+
+	t := &thriftWriter{}
+	p.encodeFileMetaData(t)
+	footer := t.buf.Bytes()
+
+	var footerLen [4]byte
+	binary.LittleEndian.PutUint32(footerLen[:], uint32(len(footer)))
+
+	for _, b := range [][]byte{footer, footerLen[:], []byte(parquetMagic)} {
+		if _, err := p.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parquetWriter) writeMagic() error {
+	if p.started {
+		return nil
+	}
+	p.started = true
+	_, err := p.w.Write([]byte(parquetMagic))
+	return err
+}
+
+func (p *parquetWriter) writeRowGroup() error {
+	if err := p.writeMagic(); err != nil {
+		return err
+	}
+
+	chunks := make([]parquetChunk, len(p.columns))
+	for i, c := range p.columns {
+		page := c.encodePage()
+		uncompressedLen := len(page)
+		page, err := compressBlock(p.compression, page)
+		if err != nil {
+			return err
+		}
+
+		t := &thriftWriter{}
+		t.i32Field(1, parquetPageTypeData)
+		t.i32Field(2, int32(uncompressedLen))
+		t.i32Field(3, int32(len(page)))
+		t.structBegin(5) // DataPageHeader
+		t.i32Field(1, int32(p.rows))
+		t.i32Field(2, parquetEncodingPlain)
+		t.i32Field(3, parquetEncodingRLE)
+		t.i32Field(4, parquetEncodingRLE)
+		t.structEnd()
+		t.stop()
+
+		offset := p.w.n
+		if _, err := p.w.Write(t.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(page); err != nil {
+			return err
+		}
+
+		chunks[i] = parquetChunk{
+			column:           c,
+			offset:           offset,
+			numValues:        int64(p.rows),
+			uncompressedSize: int64(t.buf.Len() + uncompressedLen),
+			compressedSize:   int64(t.buf.Len() + len(page)),
+		}
+		c.reset()
+	}
+
+	p.rowGroups = append(p.rowGroups, chunks)
+	p.totalRows += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+// encodePage returns the definition levels and the values of a data page
+func (c *parquetColumn) encodePage() []byte {
+	var buf bytes.Buffer
+
+	if c.optional {
+		levels := encodeRLELevels(c.defLevels)
+		var l [4]byte
+		binary.LittleEndian.PutUint32(l[:], uint32(len(levels)))
+		buf.Write(l[:])
+		buf.Write(levels)
+	}
+
+	var b [8]byte
+	switch c.physType {
+	case parquetInt64:
+		for _, v := range c.ints {
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			buf.Write(b[:])
+		}
+	case parquetDouble:
+		for _, v := range c.floats {
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			buf.Write(b[:])
+		}
+	case parquetBoolean: // Bit-packed, LSB first
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		buf.Write(packed)
+	case parquetByteArray:
+		for _, v := range c.binaries {
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+			buf.Write(b[:4])
+			buf.Write(v)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// encodeRLELevels encodes definition levels (bit width 1) using RLE runs of the RLE/bit-packing hybrid encoding
+func encodeRLELevels(levels []bool) []byte {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		n := binary.PutUvarint(tmp[:], uint64(j-i)<<1)
+		buf.Write(tmp[:n])
+		if levels[i] {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
+
+func (p *parquetWriter) encodeFileMetaData(t *thriftWriter) {
+	t.i32Field(1, 1) // version
+
+	t.listBegin(2, thriftStruct, len(p.columns)+1) // schema
+	t.elemBegin()
+	t.binaryField(4, []byte("schema"))
+	t.i32Field(5, int32(len(p.columns)))
+	t.structEnd()
+	for _, c := range p.columns {
+		t.elemBegin()
+		t.i32Field(1, c.physType)
+		if c.optional {
+			t.i32Field(3, parquetOptional)
+		} else {
+			t.i32Field(3, parquetRequired)
+		}
+		t.binaryField(4, []byte(c.name))
+		if c.converted >= 0 {
+			t.i32Field(6, c.converted)
+		}
+		switch {
+		case c.logical != nil:
+			t.structBegin(10)
+			c.logical(t)
+			t.structEnd()
+		case c.converted == parquetConvertedUTF8:
+			t.structBegin(10)
+			t.structBegin(1) // STRING
+			t.structEnd()
+			t.structEnd()
+		case c.converted == parquetConvertedJSON:
+			t.structBegin(10)
+			t.structBegin(12) // JSON
+			t.structEnd()
+			t.structEnd()
+		}
+		t.structEnd()
+	}
+
+	t.i64Field(3, p.totalRows) // num_rows
+
+	t.listBegin(4, thriftStruct, len(p.rowGroups)) // row_groups
+	for _, chunks := range p.rowGroups {
+		t.elemBegin()
+		var totalSize, numRows int64
+		t.listBegin(1, thriftStruct, len(chunks)) // columns
+		for _, ch := range chunks {
+			t.elemBegin()
+			t.i64Field(2, ch.offset) // file_offset
+			t.structBegin(3)         // ColumnMetaData
+			t.i32Field(1, ch.column.physType)
+			if ch.column.optional {
+				t.listBegin(2, thriftI32, 2)
+				t.i32(parquetEncodingPlain)
+				t.i32(parquetEncodingRLE)
+			} else {
+				t.listBegin(2, thriftI32, 1)
+				t.i32(parquetEncodingPlain)
+			}
+			t.listBegin(3, thriftBinary, 1)
+			t.binary([]byte(ch.column.name))
+			t.i32Field(4, compressions[p.compression].parquetCodec)
+			t.i64Field(5, ch.numValues)
+			t.i64Field(6, ch.uncompressedSize)
+			t.i64Field(7, ch.compressedSize)
+			t.i64Field(9, ch.offset) // data_page_offset
+			t.structEnd()
+			t.structEnd()
+
+			totalSize += ch.uncompressedSize
+			numRows = ch.numValues
+		}
+		t.i64Field(2, totalSize)
+		t.i64Field(3, numRows)
+		t.structEnd()
+	}
+
+	t.binaryField(6, []byte("data-api-server")) // created_by
+	t.stop()
+}
+
+// Thrift compact protocol types
+const (
+	thriftBoolTrue  = 1
+	thriftBoolFalse = 2
+	thriftI32       = 5
+	thriftI64       = 6
+	thriftBinary    = 8
+	thriftList      = 9
+	thriftStruct    = 12
+)
+
+// thriftWriter encodes Thrift structs using the compact protocol, just enough for Parquet metadata
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastIDs []int16 // Last field id of each open struct
+	lastID  int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	t.buf.Write(tmp[:n])
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(uint64((uint16(id) << 1) ^ uint16(id>>15))) // zigzag i16
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.varint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (t *thriftWriter) i64(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) binary(b []byte) {
+	t.varint(uint64(len(b)))
+	t.buf.Write(b)
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.i64(v)
+}
+
+func (t *thriftWriter) binaryField(id int16, b []byte) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(b)
+}
+
+func (t *thriftWriter) boolField(id int16, v bool) {
+	if v {
+		t.fieldHeader(id, thriftBoolTrue)
+	} else {
+		t.fieldHeader(id, thriftBoolFalse)
+	}
+}
+
+func (t *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+// structBegin starts a struct field
+func (t *thriftWriter) structBegin(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.elemBegin()
+}
+
+// elemBegin starts a struct without a field header, ie. a list element
+func (t *thriftWriter) elemBegin() {
+	t.lastIDs = append(t.lastIDs, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.stop()
+	t.lastID = t.lastIDs[len(t.lastIDs)-1]
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+// stop ends a struct. For the top level struct it's called directly.
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// thriftReader decodes Thrift compact protocol structs into maps of field id to value, to check the written metadata
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.b) {
+		panic(fmt.Errorf("unexpected end at %d", r.pos))
+	}
+	r.pos++
+	return r.b[r.pos-1]
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		panic(fmt.Errorf("invalid varint at %d", r.pos))
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftBoolTrue:
+		return true
+	case thriftBoolFalse:
+		return false
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.varint())
+		if r.pos+n > len(r.b) {
+			panic(fmt.Errorf("binary of %d bytes at %d is past the end", n, r.pos))
+		}
+		r.pos += n
+		return r.b[r.pos-n : r.pos]
+	case thriftList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.varint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.readStruct()
+	}
+	panic(fmt.Errorf("unknown type %d at %d", typ, r.pos))
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var id int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.zigzag())
+		}
+		fields[id] = r.value(h & 0x0f)
+	}
+}
+
+// decodeThrift decodes a struct at the start of b, and returns the number of bytes it took
+func decodeThrift(b []byte) (s map[int16]interface{}, n int, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = e.(error)
+		}
+	}()
+	r := &thriftReader{b: b}
+	s = r.readStruct()
+	return s, r.pos, nil
+}
+
+// parquetFooter checks the magic at both ends of the file, and decodes the FileMetaData
+func parquetFooter(t *testing.T, data []byte) map[int16]interface{} {
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		t.Fatalf("file should start and end with %s: %q", parquetMagic, data)
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footerLen > len(data)-12 {
+		t.Fatalf("footer length is %d, the file is only %d bytes", footerLen, len(data))
+	}
+	footer := data[len(data)-8-footerLen : len(data)-8]
+	meta, n, err := decodeThrift(footer)
+	if err != nil {
+		t.Fatalf("could not decode the footer: %v", err)
+	}
+	if n != footerLen {
+		t.Fatalf("footer is %d bytes, but its length is %d", n, footerLen)
+	}
+	return meta
+}
+
+// parquetPage decodes the page header at offset, and returns it with the uncompressed page
+func parquetPage(t *testing.T, data []byte, offset int64, compression string) (map[int16]interface{}, []byte) {
+	header, n, err := decodeThrift(data[offset:])
+	if err != nil {
+		t.Fatalf("could not decode the page header at %d: %v", offset, err)
+	}
+	start := int(offset) + n
+	page := data[start : start+int(header[3].(int64))]
+	if newReader := compressions[compression].newReader; newReader != nil {
+		r, err := newReader(bytes.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page, err = ioutil.ReadAll(r); err != nil {
+			t.Fatalf("could not decompress the page at %d: %v", offset, err)
+		}
+	}
+	if len(page) != int(header[2].(int64)) {
+		t.Fatalf("page at %d is %d bytes, its header says %d", offset, len(page), header[2])
+	}
+	return header, page
+}
+
+// decodeRLELevels decodes the definition levels of an optional column, and returns the rest of the page
+func decodeRLELevels(t *testing.T, page []byte) ([]bool, []byte) {
+	n := int(binary.LittleEndian.Uint32(page))
+	r := &thriftReader{b: page[4 : 4+n]}
+	var levels []bool
+	for r.pos < len(r.b) {
+		h := r.varint()
+		if h&1 != 0 {
+			t.Fatalf("bit-packed run in %q, only RLE runs are written", page)
+		}
+		v := r.byte()
+		for i := uint64(0); i < h>>1; i++ {
+			levels = append(levels, v == 1)
+		}
+	}
+	return levels, page[4+n:]
+}
+
+func decodeByteArrays(page []byte) []string {
+	var values []string
+	for len(page) >= 4 {
+		n := int(binary.LittleEndian.Uint32(page))
+		values = append(values, string(page[4:4+n]))
+		page = page[4+n:]
+	}
+	return values
+}
+
+func TestParquetWriter(t *testing.T) {
+	schema := &Schema{Params: map[string]*ParamRule{
+		"count": {Type: PARAM_TYPE_INT},
+		"name":  {Type: PARAM_TYPE_STRING},
+		"ok":    {Type: PARAM_TYPE_BOOL},
+		"score": {Type: PARAM_TYPE_FLOAT},
+		"tags":  {Type: PARAM_TYPE_STRING, Multiple: true},
+	}}
+	records := []*EventRecord{
+		{tsReceived: 1000000001, data: map[string]interface{}{"ts": int64(1), "count": int64(1), "name": "a", "ok": true, "score": 1.5, "tags": []interface{}{"x", "y"}, "other": "z"}},
+		{tsReceived: 1000000002, data: map[string]interface{}{"ts": int64(2), "count": int64(2), "ok": false, "score": 2.5}},
+		{tsReceived: 1000000003, data: map[string]interface{}{"ts": int64(3), "name": "c"}},
+	}
+	columns := []string{"received", "ts", "count", "name", "ok", "score", "tags", PARQUET_EXTRA_COLUMN}
+
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		t.Run(compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newParquetWriter(&buf, schema, compression)
+			for i, r := range records {
+				if err := w.Write(r); err != nil {
+					t.Fatal(err)
+				}
+				if i == 1 { // Two row groups
+					if err := w.Flush(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			data := buf.Bytes()
+			meta := parquetFooter(t, data)
+
+			if meta[3] != int64(len(records)) {
+				t.Errorf("num_rows is %v, should be %d", meta[3], len(records))
+			}
+			var names []string
+			for _, el := range meta[2].([]interface{})[1:] {
+				names = append(names, string(el.(map[int16]interface{})[4].([]byte)))
+			}
+			if !reflect.DeepEqual(names, columns) {
+				t.Errorf("columns are %q, should be %q", names, columns)
+			}
+
+			rowGroups := meta[4].([]interface{})
+			if len(rowGroups) != 2 {
+				t.Fatalf("%d row groups, should be 2", len(rowGroups))
+			}
+			var received []int64
+			var nameLevels []bool
+			var nameValues, extraValues []string
+			var scores []float64
+			for _, rg := range rowGroups {
+				chunks := rg.(map[int16]interface{})[1].([]interface{})
+				if len(chunks) != len(columns) {
+					t.Fatalf("%d column chunks, should be %d", len(chunks), len(columns))
+				}
+				for i, ch := range chunks {
+					cm := ch.(map[int16]interface{})[3].(map[int16]interface{})
+					if cm[4] != int64(compressions[compression].parquetCodec) {
+						t.Errorf("codec of %s is %v, should be %d", columns[i], cm[4], compressions[compression].parquetCodec)
+					}
+					header, page := parquetPage(t, data, cm[9].(int64), compression)
+					if n := header[5].(map[int16]interface{})[1]; n != cm[5] {
+						t.Errorf("page of %s has %v values, its column chunk %v", columns[i], n, cm[5])
+					}
+
+					switch columns[i] {
+					case "received":
+						for ; len(page) >= 8; page = page[8:] {
+							received = append(received, int64(binary.LittleEndian.Uint64(page)))
+						}
+					case "name":
+						levels, rest := decodeRLELevels(t, page)
+						nameLevels = append(nameLevels, levels...)
+						nameValues = append(nameValues, decodeByteArrays(rest)...)
+					case "score":
+						_, rest := decodeRLELevels(t, page)
+						for ; len(rest) >= 8; rest = rest[8:] {
+							scores = append(scores, math.Float64frombits(binary.LittleEndian.Uint64(rest)))
+						}
+					case PARQUET_EXTRA_COLUMN:
+						_, rest := decodeRLELevels(t, page)
+						extraValues = append(extraValues, decodeByteArrays(rest)...)
+					}
+				}
+			}
+
+			if want := []int64{1000000001, 1000000002, 1000000003}; !reflect.DeepEqual(received, want) {
+				t.Errorf("received is %v, should be %v", received, want)
+			}
+			if want := []bool{true, false, true}; !reflect.DeepEqual(nameLevels, want) {
+				t.Errorf("definition levels of name are %v, should be %v", nameLevels, want)
+			}
+			if want := []string{"a", "c"}; !reflect.DeepEqual(nameValues, want) {
+				t.Errorf("name is %q, should be %q", nameValues, want)
+			}
+			if want := []float64{1.5, 2.5}; !reflect.DeepEqual(scores, want) {
+				t.Errorf("score is %v, should be %v", scores, want)
+			}
+			if want := []string{`{"other":"z"}`}; !reflect.DeepEqual(extraValues, want) {
+				t.Errorf("extra is %q, should be %q", extraValues, want)
+			}
+		})
+	}
+}
+
+func TestParquetWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := newParquetWriter(&buf, nil, COMPRESSION_NONE)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	meta := parquetFooter(t, buf.Bytes())
+	if meta[3] != int64(0) {
+		t.Errorf("num_rows is %v, should be 0", meta[3])
+	}
+}
+
+func TestParquetWriterUnexpectedType(t *testing.T) {
+	schema := &Schema{Params: map[string]*ParamRule{
+		"count": {Type: PARAM_TYPE_INT},
+		"ok":    {Type: PARAM_TYPE_BOOL},
+	}}
+	w := newParquetWriter(&bytes.Buffer{}, schema, COMPRESSION_NONE).(*parquetWriter)
+	if err := w.Write(&EventRecord{tsReceived: 1, data: map[string]interface{}{"ts": int64(1), "count": "3", "ok": true}}); err != nil {
+		t.Fatal(err)
+	}
+	if levels := w.params["count"].defLevels; !reflect.DeepEqual(levels, []bool{false}) || len(w.params["count"].ints) != 0 {
+		t.Errorf("count should be null, definition levels are %v and values %v", levels, w.params["count"].ints)
+	}
+	if levels := w.params["ok"].defLevels; !reflect.DeepEqual(levels, []bool{true}) {
+		t.Errorf("ok shouldn't be null, definition levels are %v", levels)
+	}
+
+	if err := w.Write(&EventRecord{tsReceived: 2, data: map[string]interface{}{"ts": "1"}}); err == nil {
+		t.Error("a string ts should be an error")
+	}
+	for _, c := range w.columns {
+		n := len(c.ints) // received and ts
+		if c.optional {
+			n = len(c.defLevels)
+		}
+		if n != 1 {
+			t.Errorf("column %s has %d values, the failed record shouldn't be in it", c.name, n)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_PATH_TEMPLATE is the storage layout: <datadir>/<YYYY>/<MM>/<DD>/<HH>_<EventType>.<ext>
+const DEFAULT_PATH_TEMPLATE = "{yyyy}/{mm}/{dd}/{hh}_{event}.{ext}"
+
+const (
+	DIGITS     = "0123456789"
+	HEX_DIGITS = "0123456789abcdef"
+)
+
+// Length of {partition}, can be set with {partition:<n>}
+const (
+	DEFAULT_PARTITION_LENGTH = 2
+	MAX_PARTITION_LENGTH     = 8 // Hex digits of the 32-bit hash
+)
+
+// pathValues are used to render a path template for a record
+type pathValues struct {
+	event string
+	host  string
+	ext   string
+	t     time.Time
+	seq   int
+}
+
+type pathToken struct {
+	value    func(v *pathValues) string
+	chars    string // Characters the value consists of. Empty if the value is the same for all files of the event type.
+	min, max int    // Length of the value if chars is set, max 0 is unlimited
+}
+
+var pathTokens = map[string]pathToken{
+	"event":     {func(v *pathValues) string { return v.event }, "", 0, 0},
+	"host":      {func(v *pathValues) string { return v.host }, "", 0, 0},
+	"ext":       {func(v *pathValues) string { return v.ext }, "", 0, 0},
+	"yyyy":      {func(v *pathValues) string { return v.t.Format("2006") }, DIGITS, 4, 4},
+	"mm":        {func(v *pathValues) string { return v.t.Format("01") }, DIGITS, 2, 2},
+	"dd":        {func(v *pathValues) string { return v.t.Format("02") }, DIGITS, 2, 2},
+	"hh":        {func(v *pathValues) string { return v.t.Format("15") }, DIGITS, 2, 2},
+	"seq":       {func(v *pathValues) string { return strconv.Itoa(v.seq) }, DIGITS, 1, 0},
+	"partition": {nil, HEX_DIGITS, DEFAULT_PARTITION_LENGTH, DEFAULT_PARTITION_LENGTH}, // Rendered from the hash of the rest of the path
+}
+
+// Used for the {host} token
+var hostname = func() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "localhost"
+	}
+	return h
+}()
+
+// PathTemplate is the layout of the storage files under the data directory, ie. "{event}/{yyyy}/{mm}/{dd}/{hh}-{host}-{seq}.{ext}"
+type PathTemplate struct {
+	raw      string
+	segments []pathSegment
+}
+
+type pathSegment struct {
+	literal  string
+	token    string // Empty for literal segments
+	optional bool   // Only rendered if seq > 0, with literal as prefix. Used for the implicit {seq}
+	length   int    // Set with {token:<n>}, only for {partition}
+}
+
+// pathToken returns the token of the segment, with the length set in the template
+func (seg pathSegment) pathToken() pathToken {
+	t := pathTokens[seg.token]
+	if seg.length > 0 {
+		t.min, t.max = seg.length, seg.length
+	}
+	return t
+}
+
+// checkPathComponents rejects empty, "." and ".." components of a relative path, so that it stays under the directory it's joined to
+func checkPathComponents(s string) error {
+	for _, part := range strings.Split(s, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid path component %q in %s", part, s)
+		}
+	}
+	return nil
+}
+
+func ParsePathTemplate(s string) (*PathTemplate, error) {
+	if s == "" {
+		return nil, errors.New("path template can't be empty")
+	}
+	if strings.HasPrefix(s, "/") {
+		return nil, errors.New("path template should be relative to the data directory")
+	}
+	if err := checkPathComponents(s); err != nil {
+		return nil, err
+	}
+
+	p := &PathTemplate{raw: s}
+	for s != "" {
+		i := strings.IndexAny(s, "{}")
+		if i < 0 {
+			p.segments = append(p.segments, pathSegment{literal: s})
+			break
+		}
+		if s[i] == '}' {
+			return nil, fmt.Errorf("unexpected } in %s", p.raw)
+		}
+		if i > 0 {
+			p.segments = append(p.segments, pathSegment{literal: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed { in %s", p.raw)
+		}
+		name := s[i+1 : i+j]
+		seg := pathSegment{token: name}
+		if k := strings.IndexByte(name, ':'); k >= 0 {
+			seg.token = name[:k]
+			n, err := strconv.Atoi(name[k+1:])
+			if seg.token != "partition" || err != nil || n < 1 || n > MAX_PARTITION_LENGTH {
+				return nil, fmt.Errorf("invalid token {%s} in %s, only {partition:<n>} can have a length, from 1 to %d", name, p.raw, MAX_PARTITION_LENGTH)
+			}
+			seg.length = n
+		}
+		if _, ok := pathTokens[seg.token]; !ok {
+			return nil, fmt.Errorf("unknown token {%s} in %s, should be one of %s", name, p.raw, strings.Join(pathTokenNames(), ", "))
+		}
+		p.segments = append(p.segments, seg)
+		s = s[i+j+1:]
+	}
+	return p, nil
+}
+
+func pathTokenNames() []string {
+	names := make([]string, 0, len(pathTokens))
+	for n := range pathTokens {
+		names = append(names, "{"+n+"}")
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *PathTemplate) String() string {
+	return p.raw
+}
+
+func (p *PathTemplate) has(token string) bool {
+	for _, seg := range p.segments {
+		if seg.token == token {
+			return true
+		}
+	}
+	return false
+}
+
+// withSeq returns a template which can render different files for the same time.
+// If there's no {seq} in it, "_<seq>" is added before the ".{ext}" at the end (or at the end), only for seq > 0.
+func (p *PathTemplate) withSeq() *PathTemplate {
+	if p.has("seq") {
+		return p
+	}
+
+	n := len(p.segments)
+	seq := pathSegment{literal: "_", token: "seq", optional: true}
+	q := &PathTemplate{raw: p.raw, segments: make([]pathSegment, 0, n+2)}
+	if n >= 2 && p.segments[n-1].token == "ext" && p.segments[n-2].token == "" && strings.HasSuffix(p.segments[n-2].literal, ".") {
+		q.segments = append(q.segments, p.segments[:n-2]...)
+		if lit := strings.TrimSuffix(p.segments[n-2].literal, "."); lit != "" {
+			q.segments = append(q.segments, pathSegment{literal: lit})
+		}
+		q.segments = append(q.segments, seq, pathSegment{literal: "."}, p.segments[n-1])
+	} else {
+		q.segments = append(q.segments, p.segments...)
+		q.segments = append(q.segments, seq)
+	}
+	return q
+}
+
+func (p *PathTemplate) render(v *pathValues) string {
+	path := p.renderWithPartition(v, "")
+	if p.has("partition") {
+		// Same file, same partition
+		h := fnv.New32a()
+		h.Write([]byte(path))
+		path = p.renderWithPartition(v, fmt.Sprintf("%08x", h.Sum32()))
+	}
+	return path
+}
+
+func (p *PathTemplate) renderWithPartition(v *pathValues, partition string) string {
+	var b strings.Builder
+	for _, seg := range p.segments {
+		switch {
+		case seg.token == "":
+			b.WriteString(seg.literal)
+		case seg.optional:
+			if v.seq > 0 {
+				b.WriteString(seg.literal)
+				b.WriteString(pathTokens[seg.token].value(v))
+			}
+		case seg.token == "partition":
+			if partition != "" {
+				b.WriteString(partition[:seg.pathToken().max])
+			}
+		default:
+			b.WriteString(pathTokens[seg.token].value(v))
+		}
+	}
+	return b.String()
+}
+
+// pathNFA matches all the paths a template can render for an event type
+type pathNFA struct {
+	edges [][]nfaEdge // By state, 0 is the initial state
+	final int
+}
+
+type nfaEdge struct {
+	chars string // Empty for epsilon edges
+	to    int
+}
+
+func (n *pathNFA) newState() int {
+	n.edges = append(n.edges, nil)
+	return len(n.edges) - 1
+}
+
+func (n *pathNFA) edge(from int, chars string) int {
+	to := n.newState()
+	n.edges[from] = append(n.edges[from], nfaEdge{chars, to})
+	return to
+}
+
+// nfa builds the matcher of the paths under prefix. Only the fixed values (event, host, ext) are used from v.
+func (p *PathTemplate) nfa(prefix string, v *pathValues) *pathNFA {
+	n := &pathNFA{}
+	cur := n.newState()
+	literal := func(s string) {
+		for i := 0; i < len(s); i++ {
+			cur = n.edge(cur, s[i:i+1])
+		}
+	}
+
+	literal(prefix)
+	for _, seg := range p.segments {
+		if seg.token == "" {
+			literal(seg.literal)
+			continue
+		}
+
+		start := cur
+		if seg.optional {
+			literal(seg.literal)
+		}
+		t := seg.pathToken()
+		if t.chars == "" {
+			literal(t.value(v))
+		} else {
+			for i := 0; i < t.min; i++ {
+				cur = n.edge(cur, t.chars)
+			}
+			if t.max == 0 {
+				n.edges[cur] = append(n.edges[cur], nfaEdge{t.chars, cur})
+			}
+		}
+		// Continue from a new state, so that skipping an optional segment doesn't end up in a loop
+		end := n.newState()
+		n.edges[cur] = append(n.edges[cur], nfaEdge{"", end})
+		if seg.optional {
+			n.edges[start] = append(n.edges[start], nfaEdge{"", end})
+		}
+		cur = end
+	}
+	n.final = cur
+	return n
+}
+
+// match tells if the path is matched
+func (n *pathNFA) match(path string) bool {
+	cur := n.closure([]int{0})
+	for i := 0; i < len(path) && len(cur) > 0; i++ {
+		var next []int
+		for _, st := range cur {
+			for _, e := range n.edges[st] {
+				if e.chars != "" && strings.IndexByte(e.chars, path[i]) >= 0 {
+					next = append(next, e.to)
+				}
+			}
+		}
+		cur = n.closure(next)
+	}
+	for _, st := range cur {
+		if st == n.final {
+			return true
+		}
+	}
+	return false
+}
+
+// closure adds the states reachable with epsilon edges
+func (n *pathNFA) closure(states []int) []int {
+	seen := make(map[int]bool, len(states))
+	var out []int
+	for len(states) > 0 {
+		st := states[len(states)-1]
+		states = states[:len(states)-1]
+		if seen[st] {
+			continue
+		}
+		seen[st] = true
+		out = append(out, st)
+		for _, e := range n.edges[st] {
+			if e.chars == "" {
+				states = append(states, e.to)
+			}
+		}
+	}
+	return out
+}
+
+// intersect returns a path matched by both, or false if there's none
+func (a *pathNFA) intersect(b *pathNFA) (string, bool) {
+	type pair struct{ a, b int }
+	type step struct {
+		prev pair
+		c    byte // 0 for epsilon steps
+	}
+
+	start := pair{0, 0}
+	visited := map[pair]step{start: {}}
+	queue := []pair{start}
+	visit := func(from, to pair, c byte) {
+		if _, ok := visited[to]; !ok {
+			visited[to] = step{from, c}
+			queue = append(queue, to)
+		}
+	}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if cur.a == a.final && cur.b == b.final {
+			var path []byte
+			for p := cur; p != start; p = visited[p].prev {
+				if c := visited[p].c; c != 0 {
+					path = append(path, c)
+				}
+			}
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return string(path), true
+		}
+
+		for _, ea := range a.edges[cur.a] {
+			if ea.chars == "" {
+				visit(cur, pair{ea.to, cur.b}, 0)
+			}
+		}
+		for _, eb := range b.edges[cur.b] {
+			if eb.chars == "" {
+				visit(cur, pair{cur.a, eb.to}, 0)
+			}
+		}
+		for _, ea := range a.edges[cur.a] {
+			if ea.chars == "" {
+				continue
+			}
+			for _, eb := range b.edges[cur.b] {
+				if eb.chars == "" {
+					continue
+				}
+				for i := 0; i < len(ea.chars); i++ {
+					if strings.IndexByte(eb.chars, ea.chars[i]) >= 0 {
+						visit(cur, pair{ea.to, eb.to}, ea.chars[i])
+						break
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// pathPeriods parses the period (ie. the hour) of the files from their paths, for the retention
+type pathPeriods struct {
+	re     *regexp.Regexp
+	groups map[string]int // Submatch index of the date tokens
+}
+
+// periods builds the parser of the paths under prefix. Returns nil if the template doesn't have a {yyyy}.
+func (p *PathTemplate) periods(prefix string, v *pathValues) *pathPeriods {
+	if !p.has("yyyy") {
+		return nil
+	}
+
+	pp := &pathPeriods{groups: make(map[string]int)}
+	var b strings.Builder
+	b.WriteString("^" + regexp.QuoteMeta(prefix))
+	n := 0
+	for _, seg := range p.segments {
+		if seg.token == "" {
+			b.WriteString(regexp.QuoteMeta(seg.literal))
+			continue
+		}
+		if seg.optional {
+			b.WriteString("(?:" + regexp.QuoteMeta(seg.literal))
+		}
+		t := seg.pathToken()
+		if t.chars == "" {
+			b.WriteString(regexp.QuoteMeta(t.value(v)))
+		} else {
+			n++
+			if _, ok := pp.groups[seg.token]; !ok {
+				pp.groups[seg.token] = n
+			}
+			max := ""
+			if t.max > 0 {
+				max = strconv.Itoa(t.max)
+			}
+			fmt.Fprintf(&b, "([%s]{%d,%s})", t.chars, t.min, max)
+		}
+		if seg.optional {
+			b.WriteString(")?")
+		}
+	}
+	b.WriteString("$")
+	pp.re = regexp.MustCompile(b.String())
+	return pp
+}
+
+// end returns the end of the period of the file, ie. the hour with {mm}, {dd} and {hh}, or the day without {hh}. ok is false if the path doesn't match.
+func (pp *pathPeriods) end(path string) (time.Time, bool) {
+	m := pp.re.FindStringSubmatch(path)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	// Each token narrows the period, as long as the larger ones are there too
+	date := [4]int{0, 1, 1, 0}
+	n := 0
+	for i, token := range []string{"yyyy", "mm", "dd", "hh"} {
+		g, ok := pp.groups[token]
+		if !ok {
+			break
+		}
+		date[i], _ = strconv.Atoi(m[g])
+		n++
+	}
+	start := time.Date(date[0], time.Month(date[1]), date[2], date[3], 0, 0, 0, time.Local)
+	switch n {
+	case 1:
+		return start.AddDate(1, 0, 0), true
+	case 2:
+		return start.AddDate(0, 1, 0), true
+	case 3:
+		return start.AddDate(0, 0, 1), true
+	}
+	return start.Add(time.Hour), true
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"github.com/alexcesaro/log"
+	"sync"
+	"time"
+)
+
+// sinkQueue is the ingestion queue of a sink which sends records from its own worker goroutine.
+// It has the same backpressure as the file Storage: records are rejected with an UnavailableError if the queue is full (after QueueTimeout with QUEUE_FULL_BLOCK), or while the worker is failing.
+type sinkQueue struct {
+	items   chan queueItem
+	full    string // One of the QUEUE_FULL_ constants
+	timeout time.Duration
+	stop    chan struct{} // Closed by close, so that retries give up
+
+	sendMu  sync.RWMutex // Held for reading while sending to items, so that close doesn't close it meanwhile
+	stopped bool
+
+	mu      sync.Mutex
+	err     error         // Last error while failing, nil if healthy
+	failing chan struct{} // Closed when the worker starts failing, to wake up blocked enqueue calls
+}
+
+type queueItem struct {
+	r     *EventRecord
+	flush chan error // Set for flush calls instead of r, receives the result of sending everything before it
+}
+
+func newSinkQueue(c *EventStorageConfig) *sinkQueue {
+	size := c.QueueSize
+	if size < 1 {
+		size = DEFAULT_QUEUE_SIZE
+	}
+	timeout := time.Duration(c.QueueTimeout)
+	if timeout <= 0 {
+		timeout = DEFAULT_QUEUE_TIMEOUT
+	}
+	return &sinkQueue{
+		items:   make(chan queueItem, size),
+		full:    c.QueueFull,
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		failing: make(chan struct{}),
+	}
+}
+
+func (q *sinkQueue) enqueue(r *EventRecord) error {
+	q.mu.Lock()
+	err, failing := q.err, q.failing
+	q.mu.Unlock()
+	if err != nil {
+		return &UnavailableError{Err: err}
+	}
+
+	q.sendMu.RLock()
+	defer q.sendMu.RUnlock()
+	if q.stopped {
+		return &UnavailableError{Err: errStorageStopped}
+	}
+
+	item := queueItem{r: r}
+	select {
+	case q.items <- item:
+		return nil
+	case <-failing:
+		return &UnavailableError{Err: q.health()}
+	default:
+	}
+	if q.full == QUEUE_FULL_REJECT {
+		return &UnavailableError{Err: errQueueFull, RetryAfter: q.timeout}
+	}
+
+	t := time.NewTimer(q.timeout)
+	defer t.Stop()
+	select {
+	case q.items <- item:
+		return nil
+	case <-failing:
+		return &UnavailableError{Err: q.health()}
+	case <-q.stop: // Don't hold up close, which waits for sendMu
+		return &UnavailableError{Err: errStorageStopped}
+	case <-t.C:
+		return &UnavailableError{Err: errQueueFull, RetryAfter: q.timeout}
+	}
+}
+
+// flush returns after the worker has sent the records queued before it
+func (q *sinkQueue) flush() error {
+	q.mu.Lock()
+	err, failing := q.err, q.failing
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan error, 1)
+	q.sendMu.RLock()
+	if q.stopped {
+		q.sendMu.RUnlock()
+		return errStorageStopped
+	}
+	select {
+	case q.items <- queueItem{flush: ch}:
+	case <-failing:
+		q.sendMu.RUnlock()
+		return q.health()
+	case <-q.stop:
+		q.sendMu.RUnlock()
+		return errStorageStopped
+	}
+	q.sendMu.RUnlock()
+	select {
+	case err = <-ch:
+		return err
+	case <-failing:
+		return q.health()
+	}
+}
+
+// close makes the worker send the rest of the queue and exit. Later enqueue and flush calls fail.
+func (q *sinkQueue) close() {
+	close(q.stop)
+	q.sendMu.Lock()
+	q.stopped = true
+	close(q.items)
+	q.sendMu.Unlock()
+}
+
+func (q *sinkQueue) health() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// setHealth is called by the worker after each attempt. Returns true if the sink recovered.
+func (q *sinkQueue) setHealth(err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	recovered := false
+	if err != nil && q.err == nil {
+		close(q.failing)
+	} else if err == nil && q.err != nil {
+		q.failing = make(chan struct{})
+		recovered = true
+	}
+	q.err = err
+	return recovered
+}
+
+func (q *sinkQueue) QueueDepth() (depth, size int) {
+	return len(q.items), cap(q.items)
+}
+
+// run hands the queued records to send in batches of up to size records, waiting up to linger for a batch to fill up.
+// Flush calls get the result of sending the current batch. Returns when the queue is closed and drained.
+func (q *sinkQueue) run(size int, linger time.Duration, send func(records []*EventRecord) error) {
+	var batch []*EventRecord
+	var timer <-chan time.Time
+	sendBatch := func() error {
+		timer = nil
+		if len(batch) == 0 {
+			return nil
+		}
+		err := send(batch)
+		batch = nil
+		return err
+	}
+
+	for {
+		select {
+		case item, ok := <-q.items:
+			if !ok {
+				sendBatch()
+				return
+			}
+			if item.flush != nil {
+				item.flush <- sendBatch()
+				continue
+			}
+			batch = append(batch, item.r)
+			if len(batch) >= size {
+				sendBatch()
+			} else if len(batch) == 1 {
+				timer = time.After(linger)
+			}
+		case <-timer:
+			sendBatch()
+		}
+	}
+}
+
+// retry calls fn until it succeeds, with a backoff. Gives up after close, returning the last error.
+func (q *sinkQueue) retry(what string, l log.Logger, fn func() error) error {
+	backoff := RETRY_MIN_BACKOFF
+	for {
+		err := fn()
+		if q.setHealth(err) {
+			l.Infof("%s: recovered", what)
+		}
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-q.stop:
+			l.Errorf("%s: %v, giving up since the sink is stopped", what, err)
+			return err
+		default:
+		}
+		l.Errorf("%s: %v, retrying in %v", what, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-q.stop:
+		}
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// A blocked enqueue gives up when the queue is closed, instead of holding up close until the queue timeout
+func TestSinkQueueCloseBlocked(t *testing.T) {
+	q := newSinkQueue(&EventStorageConfig{QueueSize: 1, QueueFull: QUEUE_FULL_BLOCK, QueueTimeout: Duration(time.Minute)})
+	if err := q.enqueue(&EventRecord{}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		res <- q.enqueue(&EventRecord{})
+	}()
+	time.Sleep(50 * time.Millisecond) // Until it's blocked
+
+	closed := make(chan struct{})
+	go func() {
+		q.close()
+		close(closed)
+	}()
+	select {
+	case err := <-res:
+		if ue, ok := err.(*UnavailableError); !ok || ue.Err != errStorageStopped {
+			t.Errorf("enqueue returned %v, should be %v", err, errStorageStopped)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue is still blocked after close")
+	}
+	<-closed
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexcesaro/log"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SINK_TYPE_REDIS = "redis"
+
+const (
+	DEFAULT_REDIS_STREAM     = "events:{event}"
+	DEFAULT_REDIS_MAX_LEN    = 1000000
+	DEFAULT_REDIS_BATCH_SIZE = 100
+	DEFAULT_REDIS_LINGER     = 10 * time.Millisecond
+)
+
+func init() {
+	RegisterSink(SINK_TYPE_REDIS, newRedisSink)
+}
+
+// RedisConfig is the destination of a redis sink. The connection is the one of the stats (-redis).
+type RedisConfig struct {
+	Stream    string   `json:"stream" yaml:"stream"`         // Key of the stream, {event} is replaced with the event type
+	MaxLen    int64    `json:"max_len" yaml:"max_len"`       // Approximate number of entries kept in the stream (MAXLEN ~), -1 to keep everything
+	BatchSize int      `json:"batch_size" yaml:"batch_size"` // Max XADDs in a pipeline
+	Linger    Duration `json:"linger" yaml:"linger"`         // How long to wait for a batch to fill up
+}
+
+func (c *RedisConfig) validate() error {
+	if c.MaxLen < -1 {
+		return fmt.Errorf("max_len: should be -1 or more")
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size: can't be negative")
+	}
+	return nil
+}
+
+// RedisSink adds each record to a Redis stream, with the fields received, event and data (JSON).
+// Records are pipelined in batches by a worker, which retries failed batches with a backoff. While it's failing, events are rejected like with a failing Storage.
+type RedisSink struct {
+	Config RedisConfig
+	Logger log.Logger
+	pool   *redis.Pool
+	queue  *sinkQueue
+	done   chan struct{}
+}
+
+func newRedisSink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	if c.redisPool == nil {
+		return nil, errors.New("Redis is not configured")
+	}
+
+	var rc RedisConfig
+	if c.Redis != nil {
+		rc = *c.Redis
+	}
+	if rc.Stream == "" {
+		rc.Stream = DEFAULT_REDIS_STREAM
+	}
+	rc.Stream = strings.Replace(rc.Stream, "{event}", e.Name, -1)
+	if rc.MaxLen == 0 {
+		rc.MaxLen = DEFAULT_REDIS_MAX_LEN
+	}
+	if rc.BatchSize == 0 {
+		rc.BatchSize = DEFAULT_REDIS_BATCH_SIZE
+	}
+	if rc.Linger == 0 {
+		rc.Linger = Duration(DEFAULT_REDIS_LINGER)
+	}
+
+	s := &RedisSink{
+		Config: rc,
+		Logger: l,
+		pool:   c.redisPool,
+		queue:  newSinkQueue(c),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *RedisSink) run() {
+	defer close(s.done)
+	s.queue.run(s.Config.BatchSize, time.Duration(s.Config.Linger), s.send)
+}
+
+// send adds the records to the stream, retrying the ones which weren't added until they are or the sink is closed
+func (s *RedisSink) send(records []*EventRecord) error {
+	batch := make([][]interface{}, 0, len(records))
+	for _, r := range records {
+		args, err := s.xaddArgs(r)
+		if err != nil {
+			s.Logger.Errorf("Could not encode %s: %v", r, err)
+			continue
+		}
+		batch = append(batch, args)
+	}
+
+	err := s.queue.retry("Adding to "+s.Config.Stream, s.Logger, func() error {
+		failed, err := s.xadd(batch)
+		batch = failed
+		return err
+	})
+	if err != nil {
+		s.Logger.Errorf("Lost %d records of %s", len(batch), s.Config.Stream)
+	}
+	return err
+}
+
+func (s *RedisSink) xaddArgs(r *EventRecord) ([]interface{}, error) {
+	data, err := json.Marshal(r.data)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{s.Config.Stream}
+	if s.Config.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", s.Config.MaxLen)
+	}
+	return append(args, "*",
+		"received", strconv.FormatInt(r.tsReceived, 10),
+		"event", r.name,
+		"data", data,
+	), nil
+}
+
+// xadd pipelines the XADDs, and returns the ones which may not have been added with the connection error.
+// Error replies (ie. WRONGTYPE) only fail their own command and would fail again, so those records are dropped.
+func (s *RedisSink) xadd(batch [][]interface{}) (failed [][]interface{}, err error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for _, args := range batch {
+		if err := conn.Send("XADD", args...); err != nil {
+			return batch, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return batch, err
+	}
+	var dropped int
+	var reply error
+	defer func() {
+		if dropped > 0 {
+			s.Logger.Errorf("Dropped %d records rejected by %s: %v", dropped, s.Config.Stream, reply)
+		}
+	}()
+	for i := range batch {
+		_, rerr := conn.Receive()
+		if rerr == nil {
+			continue
+		}
+		if _, ok := rerr.(redis.Error); !ok {
+			return batch[i:], rerr // Connection error, the rest is unknown
+		}
+		if dropped == 0 {
+			reply = rerr
+		}
+		dropped++
+	}
+	return nil, nil
+}
+
+func (s *RedisSink) Enqueue(r *EventRecord) error {
+	return s.queue.enqueue(r)
+}
+
+// Flush adds the queued records, and returns after Redis has replied
+func (s *RedisSink) Flush() error {
+	return s.queue.flush()
+}
+
+// Close adds the rest of the queue, trying once if Redis is failing
+func (s *RedisSink) Close() error {
+	s.queue.close()
+	<-s.done
+	return s.queue.health()
+}
+
+func (s *RedisSink) Health() error {
+	return s.queue.health()
+}
+
+func (s *RedisSink) QueueDepth() (depth, size int) {
+	return s.queue.QueueDepth()
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alexcesaro/log"
+	"reflect"
+	"sync"
+)
+
+// Registry holds the current event types. It can be reloaded while the server is running.
+type Registry struct {
+	StorageDefaults *StorageConfig
+	Spool           *SpoolConfig // Optional
+	Logger          log.Logger
+
+	mu       sync.RWMutex // Held for reading while an event is being enqueued, so that a removed Sink is never closed before in-flight events are enqueued
+	reloadMu sync.Mutex   // Serializes Load calls
+	types    map[string]*EventType
+	names    []string          // In config order
+	spools   map[string]*Spool // Kept between reloads, since they don't depend on the settings of the event type
+}
+
+type ReloadResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Updated []string `json:"updated"`
+}
+
+func NewRegistry(storageDefaults *StorageConfig, l log.Logger) *Registry {
+	return &Registry{
+		StorageDefaults: storageDefaults,
+		Logger:          l,
+		types:           make(map[string]*EventType),
+		spools:          make(map[string]*Spool),
+	}
+}
+
+// Load replaces the registered event types with the ones in the config.
+// Sinks are created for new event types (or event types with changed storage settings), and the old ones are drained and closed after the swap.
+// A new file Storage which can write the files of an old one waits for it to close them, so records of the event type are queued until then.
+func (reg *Registry) Load(c *EventsConfig) (*ReloadResult, error) {
+	reg.reloadMu.Lock()
+	defer reg.reloadMu.Unlock()
+
+	reg.mu.RLock()
+	current := reg.types
+	reg.mu.RUnlock()
+
+	res := &ReloadResult{
+		Added:   []string{},
+		Removed: []string{},
+		Updated: []string{},
+	}
+
+	names := make([]string, len(c.Events))
+	configs := make([][]*EventStorageConfig, len(c.Events))
+	for i := range c.Events {
+		names[i] = c.Events[i].Name
+		configs[i] = c.Events[i].storageConfigs(reg.StorageDefaults)
+	}
+	if err := checkFilePaths(c, configs); err != nil {
+		return nil, err
+	}
+	if err := checkDurability(c, configs); err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]*EventType, len(c.Events))
+	spools := make(map[string]*Spool, len(c.Events))
+	var started, stopped []Sink
+	var startedSpools, stoppedSpools []*Spool
+
+	for i := range c.Events {
+		ec := &c.Events[i]
+		e, err := ec.newEventType()
+		if err == nil {
+			e.storageConfigs = configs[i]
+			if old, ok := current[e.Name]; ok {
+				res.Updated = append(res.Updated, e.Name)
+				if reflect.DeepEqual(old.storageConfigs, e.storageConfigs) && (!sinkUsesSchema(e.storageConfigs) || sameParamTypes(old.Schema, e.Schema)) {
+					e.Sink = old.Sink
+				} else {
+					stopped = append(stopped, old.Sink)
+				}
+			} else {
+				res.Added = append(res.Added, e.Name)
+			}
+			if e.Sink == nil {
+				e.Sink, err = NewFanoutSink(&e, e.storageConfigs, reg.Logger)
+				if err != nil {
+					err = fmt.Errorf("%s: %v", e.Name, err)
+				} else {
+					started = append(started, e.Sink)
+				}
+			}
+		}
+		if err == nil && reg.spooling() {
+			if e.spool = reg.spools[e.Name]; e.spool == nil {
+				e.spool, err = NewSpool(reg.Spool, e.Name, e.Sink, reg.Logger)
+				if err != nil {
+					err = fmt.Errorf("%s: spool: %v", e.Name, err)
+				} else {
+					startedSpools = append(startedSpools, e.spool)
+				}
+			}
+			spools[e.Name] = e.spool
+		}
+		if err != nil {
+			// Nothing has been swapped yet
+			reg.closeSpools(startedSpools)
+			reg.closeSinks(started)
+			return nil, err
+		}
+
+		types[e.Name] = &e
+	}
+
+	for _, n := range reg.names {
+		if _, ok := types[n]; !ok {
+			res.Removed = append(res.Removed, n)
+			stopped = append(stopped, current[n].Sink)
+			if sp := reg.spools[n]; sp != nil {
+				stoppedSpools = append(stoppedSpools, sp)
+			}
+		}
+	}
+
+	// Waits for in-flight events
+	reg.mu.Lock()
+	reg.types = types
+	reg.names = names
+	reg.spools = spools
+	for _, e := range types {
+		if e.spool != nil {
+			e.spool.setSink(e.Sink)
+		}
+	}
+	reg.mu.Unlock()
+
+	// Removed spools deliver the rest of their records to the old sinks first
+	reg.closeSpools(stoppedSpools)
+	reg.closeSinks(stopped)
+
+	return res, nil
+}
+
+func (reg *Registry) spooling() bool {
+	return reg.Spool != nil && reg.Spool.Dir != ""
+}
+
+func (reg *Registry) closeSpools(spools []*Spool) {
+	for _, sp := range spools {
+		if err := sp.Close(); err != nil {
+			reg.Logger.Errorf("Could not close spool %s: %v", sp.Name, err)
+		}
+	}
+}
+
+func (reg *Registry) closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			reg.Logger.Errorf("Could not close sink: %v", err)
+		}
+	}
+}
+
+// get should be called with mu held
+func (reg *Registry) get(name string) *EventType {
+	return reg.types[name]
+}
+
+// List returns a snapshot of the registered event types
+func (reg *Registry) List() []EventType {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	et := make([]EventType, len(reg.names))
+	for i, n := range reg.names {
+		et[i] = *reg.types[n]
+	}
+	return et
+}
+
+// Close closes all sinks
+func (reg *Registry) Close() {
+	reg.reloadMu.Lock()
+	defer reg.reloadMu.Unlock()
+
+	reg.mu.Lock()
+	sinks := make([]Sink, 0, len(reg.types))
+	spools := make([]*Spool, 0, len(reg.spools))
+	for _, t := range reg.types {
+		sinks = append(sinks, t.Sink)
+		if t.spool != nil {
+			spools = append(spools, t.spool)
+		}
+	}
+	reg.types = make(map[string]*EventType)
+	reg.names = nil
+	reg.spools = make(map[string]*Spool)
+	reg.mu.Unlock()
+
+	reg.closeSpools(spools)
+	reg.closeSinks(sinks)
+}
@@ -0,0 +1,557 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/alexcesaro/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Partial records cut from the end of a file are appended to <file>.partial, so nothing is deleted
+const PARTIAL_SUFFIX = ".partial"
+
+// REPAIR_SUFFIX is the temporary file of a compressed file being rewritten
+const REPAIR_SUFFIX = ".repair"
+
+// If a compressed file can't be read to the end, the original file is kept as <file>.corrupt (or .corrupt_<n>) before it's rewritten
+const CORRUPT_SUFFIX = ".corrupt"
+
+// repairResult describes what was wrong with a file
+type repairResult struct {
+	partial     int64  // Bytes of the partial record (after decompression), moved to the partial file
+	unreadable  bool   // The compressed stream was damaged, so the rest of the file couldn't be read
+	quarantined bool   // The whole file was moved to the partial file, ie. a parquet file without a footer
+	partialPath string // Where the partial record (or the whole file) went
+	corruptPath string // Copy of the original file if it was unreadable
+}
+
+func (r *repairResult) String() string {
+	if r.quarantined {
+		return fmt.Sprintf("incomplete file, moved to %s", r.partialPath)
+	}
+	s := fmt.Sprintf("partial record of %d bytes moved to %s", r.partial, r.partialPath)
+	if r.partial == 0 {
+		s = "no partial record"
+	}
+	if r.unreadable {
+		s += ", the end of the compressed stream was unreadable"
+		if r.corruptPath != "" {
+			s += ", the original file was kept as " + r.corruptPath
+		}
+	}
+	return s
+}
+
+// repairFile checks that the file ends with a complete record, and cuts the partial record if it doesn't.
+// The cut bytes are appended to partial. Returns nil if the file is intact. With dryRun, the file is only checked.
+func repairFile(path, partial, format, compression string, dryRun bool) (*repairResult, error) {
+	var res *repairResult
+	var err error
+	switch {
+	case storageFormats[format].ownCompression:
+		res, err = repairParquet(path, partial, dryRun)
+	case compressions[compression].newReader == nil:
+		res, err = repairPlain(path, partial, dryRun)
+	default:
+		res, err = repairCompressed(path, partial, compression, dryRun)
+	}
+	if res != nil {
+		res.partialPath = partial
+	}
+	return res, err
+}
+
+// repairPlain truncates the file after the last newline
+func repairPlain(path, partial string, dryRun bool) (*repairResult, error) {
+	flags := os.O_RDWR
+	if dryRun {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	// Look for the last newline, from the end
+	buf := make([]byte, 64*1024)
+	cut := int64(0)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		b := buf[:end-start]
+		if _, err := f.ReadAt(b, start); err != nil {
+			return nil, err
+		}
+		if end == size && b[len(b)-1] == '\n' {
+			return nil, nil
+		}
+		if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+			cut = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	res := &repairResult{partial: size - cut}
+	if dryRun {
+		return res, nil
+	}
+	if err := appendFile(partial, io.NewSectionReader(f, cut, size-cut)); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(cut); err != nil {
+		return nil, err
+	}
+	return res, f.Sync()
+}
+
+// repairCompressed rewrites the file with the complete records which can be decompressed
+func repairCompressed(path, partial, compression string, dryRun bool) (*repairResult, error) {
+	// Find the last newline in the readable part
+	var total, cut int64
+	var last byte
+	readErr := readCompressed(path, compression, func(b []byte) {
+		if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+			cut = total + int64(i) + 1
+		}
+		total += int64(len(b))
+		last = b[len(b)-1]
+	})
+	if pe, ok := readErr.(*os.PathError); ok {
+		return nil, pe
+	}
+	if readErr == nil && (total == 0 || last == '\n') {
+		return nil, nil
+	}
+
+	res := &repairResult{partial: total - cut, unreadable: readErr != nil}
+	if dryRun {
+		return res, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + REPAIR_SUFFIX
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode())
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp) // Nothing left after the rename
+	defer out.Close()
+
+	var cw compressWriter // Not created if there are no complete records, the file is left empty
+	var werr error
+	var pending bytes.Buffer // Partial record
+	var pos int64
+	err = readCompressed(path, compression, func(b []byte) {
+		if pos < cut && werr == nil {
+			n := cut - pos
+			if n > int64(len(b)) {
+				n = int64(len(b))
+			}
+			if cw == nil {
+				cw, werr = compressions[compression].newWriter(out)
+			}
+			if werr == nil {
+				_, werr = cw.Write(b[:n])
+			}
+			b = b[n:]
+			pos += n
+		}
+		pending.Write(b)
+	})
+	if pe, ok := err.(*os.PathError); ok {
+		return nil, pe
+	}
+	if werr == nil && cw != nil {
+		werr = cw.Close()
+	}
+	if werr != nil {
+		return nil, werr
+	}
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+	if pending.Len() > 0 {
+		if err := appendFile(partial, &pending); err != nil {
+			return nil, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if res.unreadable {
+		if res.corruptPath, err = keepCorrupt(path); err != nil {
+			return nil, err
+		}
+	}
+	return res, os.Rename(tmp, path)
+}
+
+// keepCorrupt links (or copies) the file to the next free CORRUPT_SUFFIX path, so the undecodable data isn't lost when the file is rewritten
+func keepCorrupt(path string) (string, error) {
+	corrupt := path + CORRUPT_SUFFIX
+	for i := 1; fileExists(corrupt); i++ {
+		corrupt = fmt.Sprintf("%s%s_%d", path, CORRUPT_SUFFIX, i)
+	}
+	if os.Link(path, corrupt) == nil {
+		return corrupt, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := appendFile(corrupt, f); err != nil {
+		os.Remove(corrupt)
+		return "", err
+	}
+	return corrupt, nil
+}
+
+// readCompressed calls fn with the decompressed data, until the end of the file or the first error
+func readCompressed(path, compression string, fn func(b []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := compressions[compression].newReader(bufio.NewReader(f))
+	if err == io.EOF {
+		return nil // Empty file
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			fn(buf[:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// repairParquet moves the file aside if it doesn't have a footer. The row groups can't be read without it.
+func repairParquet(path, partial string, dryRun bool) (*repairResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	head, tail := make([]byte, 4), make([]byte, 4)
+	ok := fi.Size() >= 12
+	if ok {
+		_, err1 := f.ReadAt(head, 0)
+		_, err2 := f.ReadAt(tail, fi.Size()-4)
+		ok = err1 == nil && err2 == nil && string(head) == parquetMagic && string(tail) == parquetMagic
+	}
+	f.Close()
+	if ok {
+		return nil, nil
+	}
+
+	res := &repairResult{partial: fi.Size(), quarantined: true}
+	if dryRun {
+		return res, nil
+	}
+	if fileExists(partial) {
+		return nil, fmt.Errorf("%s already exists", partial)
+	}
+	return res, os.Rename(path, partial)
+}
+
+func appendFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writingFiles counts the writers of each file (by absolute path) in the process, so that a file isn't repaired while another Storage writes to it,
+// ie. the one being replaced on reload
+var writingFiles = struct {
+	sync.Mutex
+	m        map[string]int
+	expiring map[string]bool // Files being removed by the retention janitor
+}{m: make(map[string]int), expiring: make(map[string]bool)}
+
+// Signaled when a file isn't expiring anymore
+var expiredFile = sync.NewCond(&writingFiles.Mutex)
+
+// claimFile registers a writer of the file, and tells if it's the only one. If the file is being expired, waits until it's gone.
+func claimFile(path string) bool {
+	path, _ = filepath.Abs(path)
+	writingFiles.Lock()
+	defer writingFiles.Unlock()
+	for writingFiles.expiring[path] {
+		expiredFile.Wait()
+	}
+	writingFiles.m[path]++
+	return writingFiles.m[path] == 1
+}
+
+// claimExpiring marks the file as being expired, unless it's being written to. Writers wait until releaseExpiring.
+func claimExpiring(path string) bool {
+	path, _ = filepath.Abs(path)
+	writingFiles.Lock()
+	defer writingFiles.Unlock()
+	if writingFiles.m[path] > 0 || writingFiles.expiring[path] {
+		return false
+	}
+	writingFiles.expiring[path] = true
+	return true
+}
+
+func releaseExpiring(path string) {
+	path, _ = filepath.Abs(path)
+	writingFiles.Lock()
+	defer writingFiles.Unlock()
+	delete(writingFiles.expiring, path)
+	expiredFile.Broadcast()
+}
+
+func releaseFile(path string) {
+	path, _ = filepath.Abs(path)
+	writingFiles.Lock()
+	defer writingFiles.Unlock()
+	if writingFiles.m[path]--; writingFiles.m[path] <= 0 {
+		delete(writingFiles.m, path)
+	}
+}
+
+// repair repairs a file of the storage, and logs what was done
+func (s *Storage) repair(path string) error {
+	res, err := repairFile(path, path+PARTIAL_SUFFIX, s.Config.Format, s.Config.Compression, false)
+	if err != nil {
+		return fmt.Errorf("Could not repair %s: %v", path, err)
+	}
+	if res != nil {
+		s.Logger.Warningf("Repaired %s: %s", path, res)
+	}
+	return nil
+}
+
+// recoverFiles finalizes the files of the storage which weren't finalized in the last run, ie. because the process was killed.
+// They're repaired first. Files which are written to by another Storage are skipped.
+func (s *Storage) recoverFiles() {
+	if s.nfa == nil || s.Config.Finalize == FINALIZE_NONE {
+		return
+	}
+
+	var paths []string // Final paths
+	s.walkFiles("unfinalized files", func(path string, fi os.FileInfo) {
+		switch s.Config.Finalize {
+		case FINALIZE_RENAME:
+			if final := strings.TrimSuffix(path, INPROGRESS_SUFFIX); final != path && s.nfa.match(final) {
+				paths = append(paths, final)
+			}
+		case FINALIZE_DONE:
+			if s.nfa.match(path) && !fileExists(path+DONE_SUFFIX) {
+				paths = append(paths, path)
+			}
+		}
+	})
+
+	for _, path := range paths {
+		s.recoverFile(path)
+	}
+}
+
+// recoverFile repairs and finalizes a file left over from the last run. Skipped if another Storage is writing to it.
+func (s *Storage) recoverFile(path string) {
+	writePath := path
+	if s.Config.Finalize == FINALIZE_RENAME {
+		writePath += INPROGRESS_SUFFIX
+	}
+	// Claimed meanwhile, so that it's not expired
+	only := claimFile(writePath)
+	defer releaseFile(writePath)
+	if !only || !fileExists(writePath) {
+		return
+	}
+
+	res, err := repairFile(writePath, path+PARTIAL_SUFFIX, s.Config.Format, s.Config.Compression, false)
+	if err != nil {
+		s.Logger.Errorf("Could not repair %s: %v", writePath, err)
+		return
+	}
+	if res != nil {
+		s.Logger.Warningf("Repaired %s: %s", writePath, res)
+		if res.quarantined {
+			return
+		}
+	}
+
+	switch s.Config.Finalize {
+	case FINALIZE_RENAME:
+		if fileExists(path) {
+			s.Logger.Errorf("Could not finalize %s, %s already exists", writePath, path)
+			return
+		}
+		err = os.Rename(writePath, path)
+	case FINALIZE_DONE:
+		err = ioutil.WriteFile(path+DONE_SUFFIX, nil, 0666)
+	}
+	if err == nil && s.Config.Durability != DURABILITY_NONE {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		s.Logger.Errorf("Could not finalize %s: %v", writePath, err)
+		return
+	}
+	s.Logger.Infof("Finalized %s, left over from the last run", path)
+	if s.closed != nil {
+		s.closed(path)
+	}
+}
+
+// walkFiles calls fn with the absolute path of each regular file under the data directory. Unreadable directories are skipped.
+func (s *Storage) walkFiles(what string, fn func(path string, fi os.FileInfo)) {
+	dir, err := filepath.Abs(s.Config.DataDir)
+	if err != nil {
+		s.Logger.Errorf("Could not look for %s: %v", what, err)
+		return
+	}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			s.Logger.Debugf("Skipping %s: %v", path, err)
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			fn(path, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		s.Logger.Errorf("Could not look for %s in %s: %v", what, dir, err)
+	}
+}
+
+// formatOfPath returns the storage format and compression of a file from its extension
+func formatOfPath(path string) (format, compression string, ok bool) {
+	for f, sf := range storageFormats {
+		for c := range compressions {
+			if sf.ownCompression && c != COMPRESSION_NONE {
+				continue
+			}
+			if strings.HasSuffix(path, "."+fileExt(f, c)) {
+				return f, c, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// RepairDir repairs the storage files under dir, recognized by their extensions (and INPROGRESS_SUFFIX).
+// With finalize, repaired and intact .inprogress files are renamed to their final names. Returns the number of files which needed a repair.
+func RepairDir(dir string, finalize, dryRun bool, l log.Logger) (int, error) {
+	repaired := 0
+	var firstErr error
+	fail := func(err error) {
+		l.Error(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			fail(fmt.Errorf("Skipping %s: %v", path, err))
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		final := strings.TrimSuffix(path, INPROGRESS_SUFFIX)
+		format, compression, ok := formatOfPath(final)
+		if !ok {
+			return nil
+		}
+
+		res, err := repairFile(path, final+PARTIAL_SUFFIX, format, compression, dryRun)
+		if err != nil {
+			fail(fmt.Errorf("Could not repair %s: %v", path, err))
+			return nil
+		}
+		if res != nil {
+			repaired++
+			if dryRun {
+				l.Infof("%s needs a repair: %s", path, res)
+			} else {
+				l.Infof("Repaired %s: %s", path, res)
+			}
+			if res.quarantined {
+				return nil
+			}
+		}
+
+		if final != path && finalize {
+			if fileExists(final) {
+				fail(fmt.Errorf("Could not rename %s, %s already exists", path, final))
+				return nil
+			}
+			if dryRun {
+				l.Infof("%s would be renamed to %s", path, final)
+				return nil
+			}
+			if err := os.Rename(path, final); err != nil {
+				fail(err)
+				return nil
+			}
+			l.Infof("Renamed %s to %s", path, final)
+		}
+		return nil
+	})
+	if err != nil {
+		fail(err)
+	}
+	return repaired, firstErr
+}
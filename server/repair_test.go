@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/alexcesaro/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func gzipData(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func gunzipData(t *testing.T, s string) string {
+	r, err := gzip.NewReader(bytes.NewReader([]byte(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRepairDir(t *testing.T) {
+	files := map[string]string{
+		"intact.ndjson":                      "{}\n{}\n",
+		"2020/partial.ndjson.inprogress":     "{}\n{",
+		"2020/intact.tsv.inprogress":         "a\tb\n",
+		"compressed.tsv.gz":                  gzipData(t, "a\nb"),
+		"nofooter.parquet":                   "PAR1",
+		"deadletter/a_webhook.jsonl":         `{"payload":`,
+		"2020/partial.ndjson.inprogress.bak": "{",
+	}
+	want := map[string]string{
+		"intact.ndjson":                      "{}\n{}\n",
+		"2020/partial.ndjson":                "{}\n",
+		"2020/partial.ndjson.partial":        "{",
+		"2020/intact.tsv":                    "a\tb\n",
+		"compressed.tsv.gz":                  "a\n", // Decompressed
+		"compressed.tsv.gz.partial":          "b",
+		"nofooter.parquet.partial":           "PAR1",
+		"deadletter/a_webhook.jsonl":         `{"payload":`,
+		"2020/partial.ndjson.inprogress.bak": "{",
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		dir := t.TempDir()
+		for name, data := range files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n, err := RepairDir(dir, true, dryRun, log.NullLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("dryRun %v: %d files were repaired, should be 3", dryRun, n)
+		}
+
+		expected := want
+		if dryRun {
+			expected = files
+		}
+		got := make(map[string]string)
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				rel, _ := filepath.Rel(dir, path)
+				data, _ := ioutil.ReadFile(path)
+				got[filepath.ToSlash(rel)] = string(data)
+			}
+			return nil
+		})
+		for name, data := range expected {
+			gotData := got[name]
+			if !dryRun && filepath.Ext(name) == ".gz" {
+				gotData = gunzipData(t, gotData)
+			}
+			if gotData != data {
+				t.Errorf("dryRun %v: %s is %q, should be %q", dryRun, name, gotData, data)
+			}
+		}
+		if len(got) != len(expected) {
+			t.Errorf("dryRun %v: files are %q, should be %q", dryRun, got, expected)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the janitor looks for expired files, besides when a Storage with a retention is started
+const RETENTION_CHECK_INTERVAL = 10 * time.Minute
+
+func (c *StorageConfig) retains() bool {
+	return c.Retention > 0 || c.RetentionBytes > 0
+}
+
+// The janitor expires the files of all the running Storages with a retention, from its own goroutine so that writes aren't blocked.
+// Each data directory is walked once per check.
+var janitor = struct {
+	sync.Once
+	wake chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// wakeJanitor makes the janitor check the files soon, and starts it if needed
+func wakeJanitor() {
+	janitor.Do(func() {
+		go runJanitor()
+	})
+	select {
+	case janitor.wake <- struct{}{}:
+	default:
+	}
+}
+
+func runJanitor() {
+	ticker := time.NewTicker(RETENTION_CHECK_INTERVAL)
+	for {
+		select {
+		case <-ticker.C:
+		case <-janitor.wake:
+		}
+		expireAll()
+	}
+}
+
+// expireAll walks the data directories of the running Storages with a retention, and expires their files
+func expireAll() {
+	byDir := make(map[string][]*Storage)
+	var dirs []string
+	liveStorages.Lock()
+	for s := range liveStorages.m {
+		if s.nfa == nil || !s.Config.retains() {
+			continue
+		}
+		dir, err := filepath.Abs(s.Config.DataDir)
+		if err != nil {
+			s.Logger.Errorf("Could not look for expired files: %v", err)
+			continue
+		}
+		if byDir[dir] == nil {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], s)
+	}
+	liveStorages.Unlock()
+
+	for _, dir := range dirs {
+		storages := byDir[dir]
+		files := make(map[*Storage][]dataFile, len(storages))
+		storages[0].walkFiles("expired files", func(path string, fi os.FileInfo) {
+			final := strings.TrimSuffix(path, INPROGRESS_SUFFIX)
+			for _, s := range storages {
+				if s.nfa.match(final) {
+					files[s] = append(files[s], s.dataFile(path, final, fi))
+					break // The Storage replacing another one on reload has the same files
+				}
+			}
+		})
+		for _, s := range storages {
+			s.expireFiles(files[s])
+		}
+	}
+}
+
+// dataFile is a file of the storage, found by expireAll
+type dataFile struct {
+	path    string
+	size    int64
+	end     time.Time // End of the period of the file from its path, or its modification time
+	modTime time.Time
+	writing bool // Open, or not finalized yet
+}
+
+func (s *Storage) dataFile(path, final string, fi os.FileInfo) dataFile {
+	f := dataFile{
+		path:    path,
+		size:    fi.Size(),
+		end:     fi.ModTime(),
+		modTime: fi.ModTime(),
+		writing: final != path,
+	}
+	if s.periods != nil {
+		if end, ok := s.periods.end(final); ok {
+			f.end = end
+		}
+	}
+	return f
+}
+
+// expireFiles removes (or archives) the files which are older than Retention, then the oldest files until the total size is below RetentionBytes.
+// Files which are being written to are counted, but kept. The .done marker and the .partial file of an expired file go with it.
+func (s *Storage) expireFiles(files []dataFile) {
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	// Oldest first. Rotated files of the same hour are ordered by when they were written.
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].end.Equal(files[j].end) {
+			return files[i].end.Before(files[j].end)
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	expiry := time.Now().Add(-s.Config.Retention)
+	for _, f := range files {
+		var reason string
+		switch {
+		case s.Config.Retention > 0 && f.end.Before(expiry):
+			reason = fmt.Sprintf("older than %v", s.Config.Retention)
+		case s.Config.RetentionBytes > 0 && total > s.Config.RetentionBytes:
+			reason = fmt.Sprintf("%d bytes of files, more than %d", total, s.Config.RetentionBytes)
+		default:
+			continue
+		}
+		if f.writing || !claimExpiring(f.path) {
+			continue
+		}
+		err := s.expire(f.path, reason)
+		releaseExpiring(f.path)
+		if err != nil {
+			s.Logger.Errorf("Could not expire %s: %v", f.path, err)
+			continue
+		}
+		total -= f.size
+	}
+}
+
+// expire removes the file, or moves it to ArchiveDir
+func (s *Storage) expire(path, reason string) error {
+	paths := []string{path}
+	for _, p := range []string{path + PARTIAL_SUFFIX, path + DONE_SUFFIX} {
+		if fileExists(p) {
+			paths = append(paths, p)
+		}
+	}
+
+	dir, err := filepath.Abs(s.Config.DataDir)
+	if err != nil {
+		return err
+	}
+	archive := ""
+	if s.Config.ArchiveDir != "" {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		archive = filepath.Join(s.Config.ArchiveDir, rel)
+	}
+
+	if s.Config.RetentionDryRun {
+		if archive != "" {
+			s.Logger.Infof("Would archive %s to %s (%s)", path, archive, reason)
+		} else {
+			s.Logger.Infof("Would remove %s (%s)", path, reason)
+		}
+		return nil
+	}
+
+	for _, p := range paths {
+		if archive != "" {
+			err = moveFile(p, archive+strings.TrimPrefix(p, path))
+		} else {
+			err = os.Remove(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if archive != "" {
+		s.Logger.Infof("Archived %s to %s (%s)", path, archive, reason)
+	} else {
+		s.Logger.Infof("Removed %s (%s)", path, reason)
+	}
+
+	// Remove the directories of the period (ie. the hour) if nothing else is in them
+	for d := filepath.Dir(path); strings.HasPrefix(d, dir+string(filepath.Separator)); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// moveFile renames the file, or copies it if the destination is on another filesystem
+func moveFile(src, dst string) error {
+	if fileExists(dst) {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	err = appendFile(dst, f)
+	f.Close()
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExpireFiles(t *testing.T) {
+	files := []string{
+		"2020/01/01/00_test.ndjson",
+		"2020/01/01/00_test.ndjson" + PARTIAL_SUFFIX,
+		"2020/01/01/00_test.ndjson" + DONE_SUFFIX,
+		"2020/01/01/01_test.ndjson" + INPROGRESS_SUFFIX, // Not finalized, so kept
+		"2021/01/01/00_test.ndjson",
+		"2999/01/01/00_test.ndjson",
+		"2020/01/01/00_other.ndjson",    // Of another event type
+		"deadletter/test_webhook.jsonl", // Not a storage file
+	}
+	oldest := files[:3]
+	expired := []string{files[0], files[1], files[2], files[4]}
+
+	tests := []struct {
+		name     string
+		config   EventStorageConfig
+		expired  []string
+		archived bool
+	}{
+		{"retention", EventStorageConfig{Retention: Duration(time.Hour)}, expired, false},
+		{"retention bytes", EventStorageConfig{RetentionBytes: 35}, oldest, false}, // 40 bytes of files
+		{"archive", EventStorageConfig{Retention: Duration(time.Hour)}, expired, true},
+		{"dry run", EventStorageConfig{Retention: Duration(time.Hour), RetentionDryRun: true}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			c.DataDir = t.TempDir()
+			if tt.archived {
+				c.ArchiveDir = t.TempDir()
+			}
+			for _, name := range files {
+				path := filepath.Join(c.DataDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte("0123456789"), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := testFileStorage(t, c)
+			liveStorages.Lock()
+			liveStorages.m[s] = true
+			liveStorages.Unlock()
+			defer func() {
+				liveStorages.Lock()
+				delete(liveStorages.m, s)
+				liveStorages.Unlock()
+			}()
+			expireAll()
+
+			var kept []string
+			for _, name := range files {
+				if !containsString(tt.expired, name) {
+					kept = append(kept, name)
+				}
+			}
+			if got := listFiles(t, c.DataDir); !reflect.DeepEqual(got, sortedStrings(kept)) {
+				t.Errorf("files are %q, should be %q", got, sortedStrings(kept))
+			}
+			if tt.archived {
+				if got := listFiles(t, c.ArchiveDir); !reflect.DeepEqual(got, sortedStrings(tt.expired)) {
+					t.Errorf("archived files are %q, should be %q", got, sortedStrings(tt.expired))
+				}
+			}
+		})
+	}
+}
+
+// listFiles returns the relative paths of the regular files under dir, sorted
+func listFiles(t *testing.T, dir string) []string {
+	var names []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sortedStrings(names)
+}
+
+func sortedStrings(s []string) []string {
+	s = append([]string(nil), s...)
+	sort.Strings(s)
+	return s
+}
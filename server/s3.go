@@ -0,0 +1,430 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_S3_ENDPOINT  = "https://s3.amazonaws.com"
+	DEFAULT_S3_REGION    = "us-east-1"
+	DEFAULT_S3_PART_SIZE = 16 << 20 // 16 MiB
+	MIN_S3_PART_SIZE     = 5 << 20  // Limits of the S3 API
+	MAX_S3_PART_SIZE     = 5 << 30
+	MAX_S3_PARTS         = 10000
+)
+
+const (
+	S3_REQUEST_TIMEOUT = 5 * time.Minute
+	S3_MAX_ATTEMPTS    = 3 // Of each request. Failed uploads are retried by the sink.
+)
+
+// S3Config is the destination of an s3 sink
+type S3Config struct {
+	Endpoint   string `json:"endpoint" yaml:"endpoint"`       // ie. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000", DEFAULT_S3_ENDPOINT by default
+	Region     string `json:"region" yaml:"region"`           // DEFAULT_S3_REGION by default
+	Bucket     string `json:"bucket" yaml:"bucket"`           // Addressed as <endpoint>/<bucket>/<key>
+	Prefix     string `json:"prefix" yaml:"prefix"`           // Prepended to the path of the file under the data directory to get the key
+	AccessKey  string `json:"access_key" yaml:"access_key"`   // AWS_ACCESS_KEY_ID by default
+	SecretKey  string `json:"secret_key" yaml:"secret_key"`   // AWS_SECRET_ACCESS_KEY by default
+	PartSize   int64  `json:"part_size" yaml:"part_size"`     // Larger files are uploaded in parts
+	VerifyETag bool   `json:"verify_etag" yaml:"verify_etag"` // Also compare the ETags to the MD5s. They aren't MD5s with SSE-KMS, SSE-C and some S3 compatible stores.
+}
+
+func (c *S3Config) validate() error {
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			return fmt.Errorf("endpoint: %v", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("endpoint: should be like http(s)://<host>[:<port>]")
+		}
+	}
+	if c.Bucket == "" {
+		return fmt.Errorf("bucket: can't be empty")
+	}
+	if strings.HasPrefix(c.Prefix, "/") {
+		return fmt.Errorf("prefix: shouldn't start with /")
+	}
+	if c.PartSize != 0 && (c.PartSize < MIN_S3_PART_SIZE || c.PartSize > MAX_S3_PART_SIZE) {
+		return fmt.Errorf("part_size: should be between %d and %d", MIN_S3_PART_SIZE, MAX_S3_PART_SIZE)
+	}
+	return nil
+}
+
+// s3Client is a minimal client of the S3 API, with the requests needed to upload files
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	partSize     int64
+	verifyETag   bool
+	http         *http.Client
+	stop         <-chan struct{} // Closed by the sink, so that requests aren't retried anymore
+}
+
+// s3Error is an error response of the S3 API
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 error: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("S3 error: HTTP %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests || e.Code == "InternalError" || e.Code == "SlowDown"
+}
+
+func newS3Client(c *S3Config) (*s3Client, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = DEFAULT_S3_ENDPOINT
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &s3Client{
+		endpoint:     u,
+		region:       c.Region,
+		bucket:       c.Bucket,
+		accessKey:    c.AccessKey,
+		secretKey:    c.SecretKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		partSize:     c.PartSize,
+		verifyETag:   c.VerifyETag,
+		http:         &http.Client{Timeout: S3_REQUEST_TIMEOUT},
+	}
+	if cl.region == "" {
+		cl.region = DEFAULT_S3_REGION
+	}
+	if cl.accessKey == "" {
+		cl.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if cl.secretKey == "" {
+		cl.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if cl.accessKey == "" || cl.secretKey == "" {
+		return nil, errors.New("No S3 credentials, set access_key and secret_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if cl.partSize == 0 {
+		cl.partSize = DEFAULT_S3_PART_SIZE
+	}
+	return cl, nil
+}
+
+// do sends a signed request, and retries it on network errors and temporary S3 errors.
+// The response body is returned, or an *s3Error if the status is not 2xx.
+func (c *s3Client) do(method, key string, query [][2]string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	var resp *http.Response
+	var data []byte
+	var err error
+	backoff := RETRY_MIN_BACKOFF
+	for attempt := 1; ; attempt++ {
+		resp, data, err = c.doOnce(method, key, query, header, body)
+		if err == nil {
+			return resp, data, nil
+		}
+		if se, ok := err.(*s3Error); ok && !se.temporary() {
+			return nil, nil, err
+		}
+		if attempt == S3_MAX_ATTEMPTS {
+			return nil, nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-c.stop:
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *s3Client) doOnce(method, key string, query [][2]string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	u := &url.URL{
+		Scheme:   c.endpoint.Scheme,
+		Host:     c.endpoint.Host,
+		Path:     "/" + c.bucket + "/" + key,
+		RawPath:  "/" + s3Escape(c.bucket, true) + "/" + s3Escape(key, false),
+		RawQuery: s3Query(query),
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		se := &s3Error{}
+		xml.Unmarshal(data, se)
+		se.Status = resp.StatusCode
+		return nil, nil, se
+	}
+	// Some errors of CompleteMultipartUpload come with a 200
+	head := data
+	if len(head) > 256 {
+		head = head[:256]
+	}
+	if bytes.Contains(head, []byte("<Error>")) {
+		se := &s3Error{}
+		if xml.Unmarshal(data, se) == nil && se.Code != "" {
+			se.Status = resp.StatusCode
+			return nil, nil, se
+		}
+	}
+	return resp, data, nil
+}
+
+// sign adds the AWS Signature Version 4 headers. All headers already in the request are signed.
+func (c *s3Client) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(req.URL.RawQuery + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical.String()))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape is the URI encoding of SigV4, which is stricter than url.PathEscape
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical query string of the params
+func s3Query(params [][2]string) string {
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = s3Escape(p[0], true) + "=" + s3Escape(p[1], true)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func md5Header(sum []byte) http.Header {
+	return http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum)}}
+}
+
+func etag(resp *http.Response) string {
+	return strings.Trim(resp.Header.Get("ETag"), `"`)
+}
+
+// putObject uploads the data as a single object. S3 checks it against the Content-MD5.
+func (c *s3Client) putObject(key string, data []byte) error {
+	sum := md5.Sum(data)
+	resp, _, err := c.do("PUT", key, nil, md5Header(sum[:]), data)
+	if err != nil {
+		return err
+	}
+	if got := etag(resp); c.verifyETag && got != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("ETag of %s is %s, should be the MD5 %x", key, got, sum)
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadMultipart uploads the file in parts of partSize. Returns the expected ETag of the object.
+func (c *s3Client) uploadMultipart(key string, f *os.File, size int64) (string, error) {
+	partSize := c.partSize
+	if size/partSize >= MAX_S3_PARTS {
+		partSize = size/(MAX_S3_PARTS-1) + 1
+	}
+
+	_, data, err := c.do("POST", key, [][2]string{{"uploads", ""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var initiate struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &initiate); err != nil || initiate.UploadId == "" {
+		return "", fmt.Errorf("Invalid response to CreateMultipartUpload: %v", err)
+	}
+	uploadID := initiate.UploadId
+
+	abort := func(err error) (string, error) {
+		if _, _, aerr := c.do("DELETE", key, [][2]string{{"uploadId", uploadID}}, nil, nil); aerr != nil {
+			err = fmt.Errorf("%v (and could not abort upload %s: %v)", err, uploadID, aerr)
+		}
+		return "", err
+	}
+
+	var parts []s3Part
+	var sums []byte // Concatenated MD5s of the parts, for the ETag of the object
+	buf := make([]byte, partSize)
+	for n := 1; ; n++ {
+		read, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+
+		sum := md5.Sum(buf[:read])
+		query := [][2]string{{"partNumber", strconv.Itoa(n)}, {"uploadId", uploadID}}
+		resp, _, err := c.do("PUT", key, query, md5Header(sum[:]), buf[:read])
+		if err != nil {
+			return abort(err)
+		}
+		got := etag(resp)
+		if c.verifyETag && got != hex.EncodeToString(sum[:]) {
+			return abort(fmt.Errorf("ETag of part %d of %s is %s, should be the MD5 %x", n, key, got, sum))
+		}
+		if got == "" {
+			return abort(fmt.Errorf("No ETag for part %d of %s", n, key))
+		}
+		parts = append(parts, s3Part{n, `"` + got + `"`})
+		sums = append(sums, sum[:]...)
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	if _, _, err := c.do("POST", key, [][2]string{{"uploadId", uploadID}}, nil, body); err != nil {
+		return abort(err)
+	}
+
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%x-%d", sum, len(parts)), nil
+}
+
+// uploadFile uploads the file, and checks the size (and with verifyETag, the ETag) of the object afterwards
+func (c *s3Client) uploadFile(path, key string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var expected string
+	if fi.Size() <= c.partSize {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if err := c.putObject(key, data); err != nil {
+			return err
+		}
+		sum := md5.Sum(data)
+		expected = hex.EncodeToString(sum[:])
+	} else {
+		expected, err = c.uploadMultipart(key, f, fi.Size())
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, _, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("Could not verify %s: %v", key, err)
+	}
+	if resp.ContentLength != fi.Size() {
+		return fmt.Errorf("Size of %s is %d, should be %d", key, resp.ContentLength, fi.Size())
+	}
+	if got := etag(resp); c.verifyETag && got != expected {
+		return fmt.Errorf("ETag of %s is %s, should be %s", key, got, expected)
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/alexcesaro/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_S3_ACCESS_KEY = "testak"
+	TEST_S3_SECRET_KEY = "testsk"
+	TEST_S3_BUCKET     = "bucket"
+)
+
+// fakeS3 is a stand-in for the S3 API, which checks the SigV4 signature of each request
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	etags    map[string]string
+	uploads  map[string]map[int][]byte
+	requests []string // Method and query of each request, ie. "PUT partNumber&uploadId"
+	opaque   bool     // ETags aren't MD5s, like with SSE-KMS
+	status   int      // Of every response if set, ie. to test retries
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		objects: make(map[string][]byte),
+		etags:   make(map[string]string),
+		uploads: make(map[string]map[int][]byte),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+var sigV4Regexp = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+// verify checks the signature the way S3 does, from the request as it was received
+func (f *fakeS3) verify(r *http.Request, body []byte) bool {
+	m := sigV4Regexp.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil || m[1] != TEST_S3_ACCESS_KEY {
+		return false
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		return false
+	}
+
+	var query []string
+	if r.URL.RawQuery != "" {
+		query = strings.Split(r.URL.RawQuery, "&")
+	}
+	sort.Strings(query)
+	lines := []string{r.Method, r.URL.EscapedPath(), strings.Join(query, "&")}
+	for _, h := range strings.Split(m[4], ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		lines = append(lines, h+":"+strings.TrimSpace(v))
+	}
+	lines = append(lines, "", m[4], r.Header.Get("X-Amz-Content-Sha256"))
+	canonical := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", r.Header.Get("X-Amz-Date"), m[2] + "/" + m[3] + "/s3/aws4_request", hex.EncodeToString(canonical[:])}, "\n")
+
+	key := []byte("AWS4" + TEST_S3_SECRET_KEY)
+	for _, s := range []string{m[2], m[3], "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	return hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(key, stringToSign))), []byte(m[5]))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+strings.Join(keys, "&")))
+
+	fail := func(status int, code string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+	if f.status != 0 {
+		fail(f.status, "ServiceUnavailable")
+		return
+	}
+	if !f.verify(r, body) {
+		fail(http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if h := r.Header.Get("Content-Md5"); h != "" {
+		sum := md5.Sum(body)
+		if h != base64.StdEncoding.EncodeToString(sum[:]) {
+			fail(http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+
+	prefix := "/" + TEST_S3_BUCKET + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		fail(http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	switch {
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", `"`+f.etag(body)+`"`)
+	case r.Method == "PUT":
+		f.objects[key] = body
+		f.etags[key] = f.etag(body)
+		w.Header().Set("ETag", `"`+f.etags[key]+`"`)
+	case r.Method == "POST" && q["uploads"] != nil:
+		id := fmt.Sprintf("upload/%d+", len(f.requests)) // Needs escaping in the query
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			fail(http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		var data, sums []byte
+		for n := 1; n <= len(parts); n++ {
+			sum := md5.Sum(parts[n])
+			data = append(data, parts[n]...)
+			sums = append(sums, sum[:]...)
+		}
+		f.objects[key] = data
+		f.etags[key] = fmt.Sprintf("%s-%d", f.etag(sums), len(parts))
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, f.etags[key])
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", `"`+f.etags[key]+`"`)
+	default:
+		fail(http.StatusBadRequest, "InvalidRequest")
+	}
+}
+
+func (f *fakeS3) etag(data []byte) string {
+	if f.opaque {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:16])
+	}
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func (f *fakeS3) requestLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func testS3Config(endpoint string) *S3Config {
+	return &S3Config{
+		Endpoint:  endpoint,
+		Bucket:    TEST_S3_BUCKET,
+		AccessKey: TEST_S3_ACCESS_KEY,
+		SecretKey: TEST_S3_SECRET_KEY,
+		PartSize:  100, // Below MIN_S3_PART_SIZE, to test multipart uploads with small files
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestS3UploadFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		requests []string
+	}{
+		{"single", 100, []string{"PUT", "HEAD"}},
+		{"multipart", 250, []string{"POST uploads", "PUT partNumber&uploadId", "PUT partNumber&uploadId", "PUT partNumber&uploadId", "POST uploadId", "HEAD"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newFakeS3(t)
+			c, err := newS3Client(testS3Config(srv.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, data := writeTestFile(t, t.TempDir(), "file.tsv", tt.size)
+
+			key := "prefix/2020/01/02/03_a b+c.tsv"
+			if err := c.uploadFile(path, key); err != nil {
+				t.Fatalf("uploadFile: %v", err)
+			}
+			if got, ok := f.object(key); !ok || string(got) != string(data) {
+				t.Errorf("object %q is %d bytes, should be the %d bytes of the file", key, len(got), len(data))
+			}
+			if got := f.requestLog(); strings.Join(got, ", ") != strings.Join(tt.requests, ", ") {
+				t.Errorf("requests are %q, should be %q", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestS3UploadFileETag(t *testing.T) {
+	for _, size := range []int{100, 250} {
+		for _, verify := range []bool{false, true} {
+			f, srv := newFakeS3(t)
+			f.opaque = true
+			sc := testS3Config(srv.URL)
+			sc.VerifyETag = verify
+			c, err := newS3Client(sc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, _ := writeTestFile(t, t.TempDir(), "file.tsv", size)
+
+			err = c.uploadFile(path, "file.tsv")
+			if verify && (err == nil || !strings.Contains(err.Error(), "ETag")) {
+				t.Errorf("uploadFile of %d bytes with verify_etag is %v, should be an ETag mismatch", size, err)
+			} else if !verify && err != nil {
+				t.Errorf("uploadFile of %d bytes without verify_etag: %v", size, err)
+			}
+		}
+	}
+}
+
+func TestS3RetryStop(t *testing.T) {
+	f, srv := newFakeS3(t)
+	f.status = http.StatusServiceUnavailable
+	c, err := newS3Client(testS3Config(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	c.stop = stop
+	path, _ := writeTestFile(t, t.TempDir(), "file.tsv", 10)
+
+	if err := c.uploadFile(path, "file.tsv"); err == nil {
+		t.Fatal("uploadFile should fail")
+	}
+	if got := f.requestLog(); len(got) != S3_MAX_ATTEMPTS {
+		t.Errorf("requests are %q, should be %d attempts", got, S3_MAX_ATTEMPTS)
+	}
+
+	close(stop)
+	if err := c.uploadFile(path, "file.tsv"); err == nil {
+		t.Fatal("uploadFile should fail")
+	}
+	if got := f.requestLog(); len(got) != S3_MAX_ATTEMPTS+1 {
+		t.Errorf("requests are %q, shouldn't be retried after stop", got)
+	}
+}
+
+func TestS3UploadFileBadSignature(t *testing.T) {
+	f, srv := newFakeS3(t)
+	sc := testS3Config(srv.URL)
+	sc.SecretKey = "wrong"
+	c, err := newS3Client(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := writeTestFile(t, t.TempDir(), "file.tsv", 10)
+
+	err = c.uploadFile(path, "file.tsv")
+	se, ok := err.(*s3Error)
+	if !ok || se.Status != http.StatusForbidden || se.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("error is %v, should be a 403 SignatureDoesNotMatch", err)
+	}
+	if got := f.requestLog(); len(got) != 1 {
+		t.Errorf("requests are %q, a 403 shouldn't be retried", got)
+	}
+}
+
+func TestS3SinkUpload(t *testing.T) {
+	f, srv := newFakeS3(t)
+	dir := t.TempDir()
+	sc := testS3Config(srv.URL)
+	sc.Prefix = "events/"
+	sc.PartSize = 0
+	c := EventStorageConfig{Type: SINK_TYPE_S3, S3: sc}.withDefaults(&StorageConfig{
+		DataDir:     dir,
+		Format:      STORAGE_FORMAT_NDJSON,
+		Compression: COMPRESSION_NONE,
+	})
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sc.PartSize = 100
+
+	e := NewEventType("test")
+	sink, err := newS3Sink(&e, c, log.NullLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		r := &EventRecord{name: e.Name, tsReceived: ts.UnixNano(), data: map[string]interface{}{"i": i, "padding": strings.Repeat("x", 20)}}
+		if err := sink.Enqueue(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "events/2020/01/02/03_test.ndjson"
+	data, ok := f.object(key)
+	if !ok {
+		t.Fatalf("%s wasn't uploaded, requests were %q", key, f.requestLog())
+	}
+	if n := strings.Count(string(data), "\n"); n != 10 {
+		t.Errorf("%s has %d records, should have 10", key, n)
+	}
+	if !containsString(f.requestLog(), "POST uploadId") {
+		t.Errorf("%s wasn't uploaded in parts, requests were %q", key, f.requestLog())
+	}
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			t.Errorf("%s should have been removed after the upload", path)
+		}
+		return nil
+	})
+}
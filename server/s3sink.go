@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alexcesaro/log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const SINK_TYPE_S3 = "s3"
+
+// Files of the s3 sink are closed (and uploaded) after this much idle time, if idle_close is not set
+const DEFAULT_S3_IDLE_CLOSE = 5 * time.Minute
+
+func init() {
+	RegisterSink(SINK_TYPE_S3, newS3Sink)
+}
+
+// S3Sink stages records in local files with a Storage, and uploads each file when it's closed.
+// The local file is deleted after the upload is verified.
+type S3Sink struct {
+	Storage *Storage
+	Config  *S3Config
+	Logger  log.Logger
+	client  *s3Client
+	dataDir string   // Absolute
+	nfa     *pathNFA // Matches the staged files
+
+	mu      sync.Mutex
+	pending []string // Closed files waiting for upload, in order
+	notify  chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	after   []chan struct{} // Uploaders of the sinks which stage the same files, ie. the one being replaced on reload
+}
+
+// liveS3Sinks are the S3Sinks with running uploaders
+var liveS3Sinks = struct {
+	sync.Mutex
+	m map[*S3Sink]bool
+}{m: make(map[*S3Sink]bool)}
+
+func newS3Sink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	client, err := newS3Client(c.S3)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := newFileStorage(e, c, l)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &S3Sink{
+		Storage: storage,
+		Config:  c.S3,
+		Logger:  l,
+		client:  client,
+		dataDir: dir,
+		nfa:     fileSinkNFA(storage.path, dir, e.Name, c),
+		notify:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	client.stop = s.closing
+
+	liveS3Sinks.Lock()
+	for o := range liveS3Sinks.m {
+		if _, ok := o.nfa.intersect(s.nfa); ok {
+			s.after = append(s.after, o.done)
+		}
+	}
+	liveS3Sinks.m[s] = true
+	liveS3Sinks.Unlock()
+
+	storage.closed = s.add
+	storage.RunInBackground()
+	go s.run()
+	return s, nil
+}
+
+// scan adds the complete files of the sink under the data directory to the pending uploads
+func (s *S3Sink) scan() {
+	var files []string
+	s.Storage.walkFiles("files to upload", func(path string, fi os.FileInfo) {
+		if s.nfa.match(path) {
+			files = append(files, path)
+		}
+	})
+	if len(files) > 0 {
+		s.Logger.Infof("Found %d files to upload in %s", len(files), s.dataDir)
+	}
+	for _, f := range files {
+		s.add(f)
+	}
+}
+
+// add is called by the Storage when a file is closed
+func (s *S3Sink) add(path string) {
+	s.mu.Lock()
+	if containsString(s.pending, path) { // Closed by the Storage before the scan found it
+		s.mu.Unlock()
+		return
+	}
+	s.pending = append(s.pending, path)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *S3Sink) next() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return ""
+	}
+	return s.pending[0]
+}
+
+func (s *S3Sink) finish() {
+	s.mu.Lock()
+	s.pending = s.pending[1:]
+	s.mu.Unlock()
+}
+
+// run uploads the pending files. Failed uploads are retried with a backoff, except after Close.
+func (s *S3Sink) run() {
+	defer close(s.done)
+	defer func() {
+		liveS3Sinks.Lock()
+		delete(liveS3Sinks.m, s)
+		liveS3Sinks.Unlock()
+	}()
+
+	// Files closed in the last run (or by the sink being replaced), but not uploaded. Scanned after the old sink is done with them, so they're not uploaded twice.
+	for _, done := range s.after {
+		select {
+		case <-done:
+		case <-s.closing: // Not used, ie. the reload failed
+			return
+		}
+	}
+	s.scan()
+
+	backoff := RETRY_MIN_BACKOFF
+	for {
+		path := s.next()
+		if path == "" {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.closing:
+				if path = s.next(); path == "" {
+					return
+				}
+			}
+		}
+
+		err := s.upload(path)
+		if err == nil {
+			s.finish()
+			backoff = RETRY_MIN_BACKOFF
+			continue
+		}
+
+		select {
+		case <-s.closing:
+			s.Logger.Errorf("Could not upload %s, it will be uploaded on the next start: %v", path, err)
+			s.finish()
+			continue
+		default:
+		}
+		s.Logger.Errorf("Could not upload %s, retrying in %v: %v", path, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-s.closing:
+		}
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+func (s *S3Sink) upload(path string) error {
+	rel, err := filepath.Rel(s.dataDir, path)
+	if err != nil {
+		return err
+	}
+	key := s.Config.Prefix + filepath.ToSlash(rel)
+
+	start := time.Now()
+	if err := s.client.uploadFile(path, key); err != nil {
+		if os.IsNotExist(err) {
+			s.Logger.Warningf("%s was removed before it was uploaded", path)
+			return nil
+		}
+		return err
+	}
+	s.Logger.Infof("Uploaded %s to s3://%s/%s in %v", path, s.Config.Bucket, key, time.Since(start))
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("Uploaded, but could not remove: %v", err) // Uploaded again, to the same key
+	}
+	return nil
+}
+
+func (s *S3Sink) Enqueue(r *EventRecord) error {
+	return s.Storage.Enqueue(r)
+}
+
+// Flush writes the buffered records to the staged files. Files are only uploaded when they're closed.
+func (s *S3Sink) Flush() error {
+	return s.Storage.Flush()
+}
+
+// Close closes the staged files and tries to upload them once. Files which couldn't be uploaded are kept for the next start.
+func (s *S3Sink) Close() error {
+	err := s.Storage.Close()
+	close(s.closing)
+	<-s.done
+	return err
+}
+
+// Health is the health of the staging Storage. Failing uploads are logged and retried, but events are still accepted.
+func (s *S3Sink) Health() error {
+	return s.Storage.Health()
+}
+
+func (s *S3Sink) QueueDepth() (depth, size int) {
+	return s.Storage.QueueDepth()
+}
+
+// stagesFiles tells if the sink writes files under its data directory
+func (c *EventStorageConfig) stagesFiles() bool {
+	return c.Type == SINK_TYPE_FILE || c.Type == SINK_TYPE_S3
+}
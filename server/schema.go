@@ -0,0 +1,319 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	PARAM_TYPE_INT    = "int"
+	PARAM_TYPE_FLOAT  = "float"
+	PARAM_TYPE_BOOL   = "bool"
+	PARAM_TYPE_STRING = "string"
+	PARAM_TYPE_ENUM   = "enum"
+)
+
+// ParamRule describes a single param in the event type config
+type ParamRule struct {
+	Type      string   `json:"type" yaml:"type"`
+	Values    []string `json:"values" yaml:"values"`         // Allowed values for enum
+	Pattern   string   `json:"pattern" yaml:"pattern"`       // Regexp for string and enum, not anchored unless you anchor it
+	MinLength int      `json:"min_length" yaml:"min_length"` // In characters, for string and enum
+	MaxLength int      `json:"max_length" yaml:"max_length"` // 0 is unlimited
+	Multiple  bool     `json:"multiple" yaml:"multiple"`     // Accept multiple values (ie. ?a=1&a=2 or a JSON array)
+
+	re *regexp.Regexp
+}
+
+// Schema is the compiled form of EventValidationConfig
+type Schema struct {
+	Required []string
+	Allowed  []string // If not empty, only these params, params with rules, and ts are accepted
+	Params   map[string]*ParamRule
+}
+
+var (
+	errNotScalar  = errors.New("Not a scalar value")
+	errNotInteger = errors.New("Not an integer")
+)
+
+type ParamError struct {
+	Param string `json:"param"`
+	Error string `json:"error"`
+}
+
+// ValidationError lists all failed params of an event
+type ValidationError struct {
+	Params []ParamError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Params))
+	for i, p := range e.Params {
+		parts[i] = fmt.Sprintf("%s %s", p.Param, p.Error)
+	}
+	return fmt.Sprintf("Invalid params: %s", strings.Join(parts, ", "))
+}
+
+func NewSchema(c *EventValidationConfig) (*Schema, error) {
+	if err := validateParamList(c.Required); err != nil {
+		return nil, fmt.Errorf("required: %v", err)
+	}
+	if err := validateParamList(c.Allowed); err != nil {
+		return nil, fmt.Errorf("allowed: %v", err)
+	}
+
+	sc := &Schema{
+		Required: c.Required,
+		Allowed:  c.Allowed,
+		Params:   make(map[string]*ParamRule, len(c.Params)),
+	}
+	for name, rule := range c.Params {
+		if name == "" {
+			return nil, fmt.Errorf("params: empty param name")
+		}
+		if name == "ts" {
+			return nil, fmt.Errorf("params.ts: ts is handled by the server")
+		}
+		if rule == nil {
+			return nil, fmt.Errorf("params.%s: no rules", name)
+		}
+		r := *rule
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("params.%s: %v", name, err)
+		}
+		sc.Params[name] = &r
+	}
+
+	for _, p := range sc.Required {
+		if !sc.isAllowed(p) {
+			return nil, fmt.Errorf("required: %s is not in allowed", p)
+		}
+	}
+
+	return sc, nil
+}
+
+func (r *ParamRule) compile() error {
+	switch r.Type {
+	case PARAM_TYPE_INT, PARAM_TYPE_FLOAT, PARAM_TYPE_BOOL:
+		if r.Pattern != "" || r.MinLength != 0 || r.MaxLength != 0 {
+			return fmt.Errorf("pattern and length limits are only supported for %s and %s", PARAM_TYPE_STRING, PARAM_TYPE_ENUM)
+		}
+	case PARAM_TYPE_STRING:
+	case PARAM_TYPE_ENUM:
+		if len(r.Values) == 0 {
+			return fmt.Errorf("values: can't be empty for %s", PARAM_TYPE_ENUM)
+		}
+	case "":
+		return fmt.Errorf("type: can't be empty")
+	default:
+		return fmt.Errorf("type: unknown type %s", r.Type)
+	}
+
+	if r.Type != PARAM_TYPE_ENUM && len(r.Values) > 0 {
+		return fmt.Errorf("values: only supported for %s", PARAM_TYPE_ENUM)
+	}
+	if r.MinLength < 0 || r.MaxLength < 0 {
+		return fmt.Errorf("length limits can't be negative")
+	}
+	if r.MaxLength != 0 && r.MinLength > r.MaxLength {
+		return fmt.Errorf("min_length is greater than max_length")
+	}
+
+	if r.Pattern != "" {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern: %v", err)
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (sc *Schema) isAllowed(p string) bool {
+	if p == "ts" || len(sc.Allowed) == 0 || sc.Params[p] != nil {
+		return true
+	}
+	return containsString(sc.Allowed, p)
+}
+
+// Validate checks the params of the record and returns a *ValidationError listing every failed param.
+// If all params are valid, params with rules are converted to their declared types, so they're stored as JSON numbers, booleans or arrays.
+func (sc *Schema) Validate(data map[string]interface{}) error {
+	var errs []ParamError
+	coerced := make(map[string]interface{}, len(sc.Params))
+
+	for _, p := range sc.Required {
+		if _, ok := data[p]; !ok {
+			errs = append(errs, ParamError{p, "is missing"})
+		}
+	}
+
+	for p, v := range data {
+		if !sc.isAllowed(p) {
+			errs = append(errs, ParamError{p, "is not allowed"})
+			continue
+		}
+		if rule := sc.Params[p]; rule != nil {
+			cv, err := rule.check(v)
+			if err != nil {
+				errs = append(errs, ParamError{p, err.Error()})
+				continue
+			}
+			coerced[p] = cv
+		}
+	}
+
+	if len(errs) == 0 {
+		for p, v := range coerced {
+			data[p] = v
+		}
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Param < errs[j].Param })
+	return &ValidationError{Params: errs}
+}
+
+// check validates the value, and returns it converted to the declared type. Values of multiple params are always returned as arrays.
+func (r *ParamRule) check(v interface{}) (interface{}, error) {
+	var values []interface{}
+	switch vv := v.(type) {
+	case []string:
+		for _, s := range vv {
+			values = append(values, s)
+		}
+	case []interface{}:
+		values = vv
+	default:
+		if !r.Multiple {
+			return r.checkValue(v)
+		}
+		values = []interface{}{v}
+	}
+
+	if !r.Multiple { // Even a one element array, ie. [5]
+		return nil, fmt.Errorf("should be a single value")
+	}
+
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		cv, err := r.checkValue(value)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = cv
+	}
+	return result, nil
+}
+
+// checkValue validates a single value and returns it in its declared type
+func (r *ParamRule) checkValue(v interface{}) (interface{}, error) {
+	switch r.Type {
+	case PARAM_TYPE_INT:
+		var (
+			i   int64
+			err error
+		)
+		switch vv := v.(type) {
+		case string:
+			i, err = strconv.ParseInt(vv, 10, 64)
+		case json.Number:
+			if i, err = vv.Int64(); err != nil {
+				i, err = jsonNumberInt(vv) // ie. 3.0 or 1e3
+			}
+		default:
+			err = errNotScalar
+		}
+		if err != nil {
+			return nil, fmt.Errorf("should be an int")
+		}
+		return i, nil
+
+	case PARAM_TYPE_FLOAT:
+		var (
+			f   float64
+			err error
+		)
+		switch vv := v.(type) {
+		case string:
+			f, err = strconv.ParseFloat(vv, 64)
+		case json.Number:
+			f, err = vv.Float64()
+		default:
+			err = errNotScalar
+		}
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) { // NaN and Inf can't be represented in JSON
+			return nil, fmt.Errorf("should be a float")
+		}
+		return f, nil
+
+	case PARAM_TYPE_BOOL:
+		switch vv := v.(type) {
+		case bool:
+			return vv, nil
+		case string:
+			if b, err := strconv.ParseBool(vv); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("should be a bool")
+	}
+
+	// String and enum
+	var s string
+	switch vv := v.(type) {
+	case string:
+		s = vv
+	case json.Number:
+		s = vv.String()
+	default:
+		return nil, fmt.Errorf("should be a string")
+	}
+
+	if r.Type == PARAM_TYPE_ENUM && !containsString(r.Values, s) {
+		return nil, fmt.Errorf("should be one of %s", strings.Join(r.Values, ", "))
+	}
+	if l := utf8.RuneCountInString(s); l < r.MinLength {
+		return nil, fmt.Errorf("should be at least %d characters", r.MinLength)
+	} else if r.MaxLength != 0 && l > r.MaxLength {
+		return nil, fmt.Errorf("should be at most %d characters", r.MaxLength)
+	}
+	if r.re != nil && !r.re.MatchString(s) {
+		return nil, fmt.Errorf("should match %s", r.Pattern)
+	}
+	return s, nil
+}
+
+// jsonNumberInt converts a number with a fraction or an exponent, if its value is an integer
+func jsonNumberInt(n json.Number) (int64, error) {
+	f, err := n.Float64()
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, errNotInteger
+	}
+	return int64(f), nil
+}
+
+// sameParamTypes tells if two schemas declare the same params with the same types
+func sameParamTypes(a, b *Schema) bool {
+	if len(a.Params) != len(b.Params) {
+		return false
+	}
+	for n, ra := range a.Params {
+		rb, ok := b.Params[n]
+		if !ok || ra.Type != rb.Type || ra.Multiple != rb.Multiple {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParamRuleCheck(t *testing.T) {
+	tests := []struct {
+		rule ParamRule
+		v    interface{}
+		want interface{} // nil if invalid
+	}{
+		{ParamRule{Type: PARAM_TYPE_INT}, json.Number("5"), int64(5)},
+		{ParamRule{Type: PARAM_TYPE_INT}, "5", int64(5)},
+		{ParamRule{Type: PARAM_TYPE_INT}, json.Number("3.0"), int64(3)},
+		{ParamRule{Type: PARAM_TYPE_INT}, json.Number("1e3"), int64(1000)},
+		{ParamRule{Type: PARAM_TYPE_INT}, json.Number("-2E2"), int64(-200)},
+		{ParamRule{Type: PARAM_TYPE_INT}, json.Number("3.5"), nil},
+		{ParamRule{Type: PARAM_TYPE_INT}, json.Number("1e30"), nil},
+		{ParamRule{Type: PARAM_TYPE_INT}, "3.0", nil},
+		{ParamRule{Type: PARAM_TYPE_INT}, true, nil},
+		{ParamRule{Type: PARAM_TYPE_INT}, []interface{}{json.Number("5")}, nil},
+		{ParamRule{Type: PARAM_TYPE_INT}, []string{"5", "6"}, nil},
+		{ParamRule{Type: PARAM_TYPE_INT, Multiple: true}, []interface{}{json.Number("5")}, []interface{}{int64(5)}},
+		{ParamRule{Type: PARAM_TYPE_INT, Multiple: true}, []string{"5", "6"}, []interface{}{int64(5), int64(6)}},
+		{ParamRule{Type: PARAM_TYPE_INT, Multiple: true}, "5", []interface{}{int64(5)}},
+		{ParamRule{Type: PARAM_TYPE_INT, Multiple: true}, []interface{}{json.Number("5"), "x"}, nil},
+		{ParamRule{Type: PARAM_TYPE_FLOAT}, json.Number("1.5"), 1.5},
+		{ParamRule{Type: PARAM_TYPE_FLOAT}, "NaN", nil},
+		{ParamRule{Type: PARAM_TYPE_BOOL}, "true", true},
+		{ParamRule{Type: PARAM_TYPE_BOOL}, false, false},
+		{ParamRule{Type: PARAM_TYPE_BOOL}, "yes", nil},
+		{ParamRule{Type: PARAM_TYPE_STRING}, json.Number("12"), "12"},
+		{ParamRule{Type: PARAM_TYPE_STRING}, []interface{}{"a"}, nil},
+		{ParamRule{Type: PARAM_TYPE_STRING, MaxLength: 2}, "abc", nil},
+		{ParamRule{Type: PARAM_TYPE_STRING, Pattern: "^[a-z]+$"}, "ab1", nil},
+		{ParamRule{Type: PARAM_TYPE_ENUM, Values: []string{"a", "b"}}, "b", "b"},
+		{ParamRule{Type: PARAM_TYPE_ENUM, Values: []string{"a", "b"}}, "c", nil},
+	}
+	for i, tt := range tests {
+		r := tt.rule
+		if err := r.compile(); err != nil {
+			t.Fatalf("tests[%d]: %v", i, err)
+		}
+		got, err := r.check(tt.v)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("tests[%d]: %s check(%#v) is %#v, should be an error", i, r.Type, tt.v, got)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tests[%d]: %s check(%#v) is %#v (%v), should be %#v", i, r.Type, tt.v, got, err, tt.want)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	sc, err := NewSchema(&EventValidationConfig{
+		Required: []string{"id"},
+		Allowed:  []string{"id", "ref"},
+		Params: map[string]*ParamRule{
+			"n":    {Type: PARAM_TYPE_INT},
+			"tags": {Type: PARAM_TYPE_STRING, Multiple: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want map[string]interface{} // The data after validation, nil if invalid
+		errs []string               // The failed params
+	}{
+		{"valid", map[string]interface{}{"id": "a", "n": "3", "ts": json.Number("1"), "tags": "x"}, map[string]interface{}{"id": "a", "n": int64(3), "ts": json.Number("1"), "tags": []interface{}{"x"}}, nil},
+		{"missing required", map[string]interface{}{"n": "3"}, nil, []string{"id"}},
+		{"not allowed", map[string]interface{}{"id": "a", "other": "x"}, nil, []string{"other"}},
+		{"all failed params", map[string]interface{}{"n": []interface{}{json.Number("5")}, "other": "x", "ref": "y"}, nil, []string{"id", "n", "other"}},
+		{"nothing converted if invalid", map[string]interface{}{"id": "a", "n": "3", "tags": []interface{}{true}}, nil, []string{"tags"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make(map[string]interface{}, len(tt.data))
+			for k, v := range tt.data {
+				data[k] = v
+			}
+			err := sc.Validate(data)
+			if tt.want != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(data, tt.want) {
+					t.Errorf("data is %#v, should be %#v", data, tt.want)
+				}
+				return
+			}
+
+			ve, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("error is %v, should be a *ValidationError", err)
+			}
+			var params []string
+			for _, p := range ve.Params {
+				params = append(params, p.Param)
+			}
+			if !reflect.DeepEqual(params, tt.errs) {
+				t.Errorf("failed params are %q, should be %q", params, tt.errs)
+			}
+			if !reflect.DeepEqual(data, tt.data) {
+				t.Errorf("data is %#v, shouldn't be changed", data)
+			}
+		})
+	}
+}
@@ -2,22 +2,33 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alexcesaro/log"
 	"gopkg.in/tylerb/graceful.v1"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 type ServerConfig struct {
-	ListenIp      string
-	ListenPort    int
-	RedisHost     string
-	RedisPort     int
-	RedisDatabase int
-	EventTypes    []EventType
+	ListenIp         string
+	ListenPort       int
+	RedisHost        string
+	RedisPort        int
+	RedisDatabase    int
+	MaxBodySize      int64 // Maximum accepted request body size in bytes, for POST requests
+	MaxBatchBodySize int64 // Same for batch requests
+	Events           *Registry
+	EventsFile       string // Config file to reload the registry from, on SIGHUP or /admin/reload
+	AdminToken       string // If empty, admin endpoints are only accessible from loopback addresses
 }
 
 type Server struct {
@@ -28,7 +39,20 @@ type Server struct {
 
 const OK_CONTENT = "Accepted"
 
+const DEFAULT_MAX_BODY_SIZE = 1 << 20 // 1 MiB
+
+var (
+	errBodyTooLarge       = errors.New("Request body too large")
+	errUnsupportedContent = errors.New("Unsupported content type")
+)
+
 func NewServer(c *ServerConfig, s *Stats, l log.Logger) *Server {
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
+	if c.MaxBatchBodySize <= 0 {
+		c.MaxBatchBodySize = DEFAULT_MAX_BATCH_BODY_SIZE
+	}
 
 	return &Server{
 		Config: c,
@@ -54,8 +78,12 @@ func (s *Server) Run() {
 	}))
 
 	mux.HandleFunc("/v1/", poorMansMiddleware(s.apiHandler))
+	mux.HandleFunc("/v1/batch", poorMansMiddleware(s.batchHandler))
 
 	mux.HandleFunc("/stats", poorMansMiddleware(s.statsHandler))
+	mux.HandleFunc("/health", s.healthHandler)
+
+	mux.HandleFunc("/admin/reload", s.adminMiddleware(s.reloadHandler))
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path != "/" {
@@ -73,6 +101,20 @@ func (s *Server) Run() {
 		},
 	}
 
+	// Reload event types on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(hup)
+		close(hup) // No more signals after Stop, this ends the reload goroutine
+	}()
+	go func() {
+		for range hup {
+			s.Logger.Info("SIGHUP received, reloading event types")
+			s.ReloadEvents()
+		}
+	}()
+
 	// Launch in separate goroutine so we can block on the main one
 	func() {
 		if err := httpServer.ListenAndServe(); err != nil {
@@ -102,12 +144,30 @@ func (s *Server) badRequest(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "400 Bad Request", http.StatusBadRequest)
 }
 
+// unavailable tells the client to retry later, since the event could not be stored
+func (s *Server) unavailable(w http.ResponseWriter, err *UnavailableError) {
+	w.Header().Set("Retry-After", strconv.Itoa(err.retryAfterSeconds()))
+	http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+}
+
+// invalidParams responds with a 400 and a JSON body listing the failed params
+func (s *Server) invalidParams(w http.ResponseWriter, verr *ValidationError) {
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"error":  "Invalid params",
+		"params": verr.Params,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(jsonData)
+}
+
 func (s *Server) apiHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Cache-control", "priviate, max-age=0, no-cache")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "-1")
 
-	s.Logger.Debugf("Request from %s: %s", req.RemoteAddr, req.URL.RequestURI())
+	s.Logger.Debugf("Request from %s: %s %s", req.RemoteAddr, req.Method, req.URL.RequestURI())
 
 	pathParts := strings.Split(req.URL.Path, "/")
 	if len(pathParts) != 3 {
@@ -117,8 +177,58 @@ func (s *Server) apiHandler(w http.ResponseWriter, req *http.Request) {
 
 	eventName := pathParts[2]
 
-	// Convert multiValues into single values if there's only one element
-	multiValues := req.URL.Query()
+	var (
+		values map[string]interface{}
+		err    error
+	)
+	switch req.Method {
+	case "GET", "HEAD":
+		values = flattenValues(req.URL.Query())
+	case "POST":
+		values, err = s.readBody(w, req)
+	case "OPTIONS": // CORS preflight, needed for JSON POSTs from browsers
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch err {
+	case nil:
+	case errBodyTooLarge:
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	case errUnsupportedContent:
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	default:
+		s.Logger.Debugf("Invalid body from %s: %v", req.RemoteAddr, err)
+		s.badRequest(w, req)
+		return
+	}
+
+	err = s.handleEvent(&EventRecord{
+		name: eventName,
+		data: values,
+	})
+	switch err := err.(type) {
+	case nil:
+		fmt.Fprint(w, OK_CONTENT)
+	case *ValidationError:
+		s.invalidParams(w, err)
+	case *UnavailableError:
+		s.unavailable(w, err)
+	default:
+		s.badRequest(w, req)
+	}
+}
+
+// Convert multiValues into single values if there's only one element
+func flattenValues(multiValues url.Values) map[string]interface{} {
 	values := make(map[string]interface{}, 8) // interface: Array of strings, or (most of the time) a single string
 
 	for k, vArr := range multiValues {
@@ -130,16 +240,67 @@ func (s *Server) apiHandler(w http.ResponseWriter, req *http.Request) {
 			values[k] = vArr
 		}
 	}
+	return values
+}
 
-	err := s.handleEvent(&EventRecord{
-		name: eventName,
-		data: values,
-	})
+// readBody parses the event parameters from a POST request. Query parameters are also taken into account, but body parameters take precedence.
+func (s *Server) readBody(w http.ResponseWriter, req *http.Request) (map[string]interface{}, error) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" && req.ContentLength == 0 {
+		return flattenValues(req.URL.Query()), nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		s.badRequest(w, req)
-	} else {
-		fmt.Fprint(w, OK_CONTENT)
+		return nil, errUnsupportedContent
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, s.Config.MaxBodySize)
+
+	switch mediaType {
+	case "application/json":
+		values := flattenValues(req.URL.Query())
+
+		// Objects and arrays are kept as-is, numbers are kept as json.Number to not lose precision
+		var body map[string]interface{}
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&body); err != nil {
+			return nil, bodyError(err)
+		}
+		if _, err := dec.Token(); err != io.EOF { // Trailing garbage after the object
+			return nil, bodyError(errors.New("Unexpected data after JSON object"))
+		}
+		if body == nil {
+			return nil, errors.New("JSON body should be an object")
+		}
+
+		for k, v := range body {
+			values[k] = v
+		}
+		return values, nil
+
+	case "application/x-www-form-urlencoded":
+		values := flattenValues(req.URL.Query())
+
+		if err := req.ParseForm(); err != nil {
+			return nil, bodyError(err)
+		}
+		for k, v := range flattenValues(req.PostForm) {
+			values[k] = v
+		}
+		return values, nil
 	}
+
+	return nil, errUnsupportedContent
+}
+
+func bodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errBodyTooLarge
+	}
+	return err
 }
 
 func getIntParam(req *http.Request, p string, empty_default, invalid_default int) (val int) {
@@ -179,7 +340,10 @@ func (s *Server) statsHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	data := make(map[string]int, 8)
-	for _, e := range s.Config.EventTypes {
+	for _, e := range s.Config.Events.List() {
+		if !e.Stats {
+			continue
+		}
 		if start != 0 || end != 0 {
 			t, _ := s.Stats.GetCounts(e.Name, start, end)
 			data[e.Name] = t
@@ -191,3 +355,30 @@ func (s *Server) statsHandler(w http.ResponseWriter, req *http.Request) {
 	response["stats"] = data
 
 }
+
+// healthHandler responds with the health of the sink of each event type, with a 503 if any of them is failing.
+// Delivery metrics are included for each sink of the event types.
+func (s *Server) healthHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusOK
+	sinks := make(map[string]string)
+	delivery := make(map[string]map[string]SinkMetrics)
+	for _, e := range s.Config.Events.List() {
+		if err := e.Sink.Health(); err != nil {
+			sinks[e.Name] = err.Error()
+			status = http.StatusServiceUnavailable
+		} else {
+			sinks[e.Name] = "ok"
+		}
+		if m, ok := e.Sink.(MetricsSink); ok {
+			delivery[e.Name] = m.Metrics()
+		}
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"sinks":    sinks,
+		"delivery": delivery,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonData)
+}
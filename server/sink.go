@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alexcesaro/log"
+	"sort"
+	"time"
+)
+
+// Sink is a destination for event records. Each EventType has its own Sink instance.
+type Sink interface {
+	// Enqueue hands the record to the sink. It might not be written yet when Enqueue returns.
+	Enqueue(r *EventRecord) error
+	// Flush writes buffered records
+	Flush() error
+	// Close flushes and releases resources. Enqueue can't be called after Close.
+	Close() error
+	// Health returns nil if the sink is working, or the last error if it's not
+	Health() error
+}
+
+// UnavailableError means the sink can't accept records right now, and the client should retry later
+type UnavailableError struct {
+	Err        error
+	RetryAfter time.Duration // DEFAULT_RETRY_AFTER if 0
+}
+
+const DEFAULT_RETRY_AFTER = 5 * time.Second
+
+// QueueSink is implemented by sinks with an ingestion queue
+type QueueSink interface {
+	// QueueDepth returns the number of queued records and the size of the queue
+	QueueDepth() (depth, size int)
+}
+
+// MetricsSink is implemented by sinks which keep delivery counters, by sink name
+type MetricsSink interface {
+	Metrics() map[string]SinkMetrics
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("Storage unavailable: %v", e.Err)
+}
+
+// retryAfterSeconds is the value of the Retry-After header
+func (e *UnavailableError) retryAfterSeconds() int {
+	d := e.RetryAfter
+	if d <= 0 {
+		d = DEFAULT_RETRY_AFTER
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// SinkFactory creates a running Sink for an event type. The Sink field of the EventType is not set yet.
+type SinkFactory func(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error)
+
+var sinkFactories = make(map[string]SinkFactory)
+
+// RegisterSink makes a sink type available to the storage.type setting in the event types config. Should be called from init().
+func RegisterSink(sinkType string, f SinkFactory) {
+	if _, ok := sinkFactories[sinkType]; ok {
+		panic(fmt.Sprintf("Sink type %s is already registered", sinkType))
+	}
+	sinkFactories[sinkType] = f
+}
+
+// unavailableSinks are the sink types left out of the binary by build tags, with the reason
+var unavailableSinks = make(map[string]string)
+
+func registerUnavailableSink(sinkType, reason string) {
+	unavailableSinks[sinkType] = reason
+}
+
+func NewSink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	if reason, ok := unavailableSinks[c.Type]; ok {
+		return nil, fmt.Errorf("Sink type %s is not available: %s", c.Type, reason)
+	}
+	f, ok := sinkFactories[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown sink type %s", c.Type)
+	}
+	return f(e, c, l)
+}
+
+// sinkUsesSchema tells if the sinks have to be recreated when the declared params of the event type change
+func sinkUsesSchema(configs []*EventStorageConfig) bool {
+	for _, c := range configs {
+		if c.stagesFiles() && storageFormats[c.Format].usesSchema {
+			return true
+		}
+	}
+	return false
+}
+
+func sinkTypes() []string {
+	types := make([]string, 0, len(sinkFactories))
+	for t := range sinkFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,480 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexcesaro/log"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolConfig configures the write-ahead spool between the server and the sinks
+type SpoolConfig struct {
+	Dir         string // Spooling is disabled if empty. Each event type has its own subdirectory.
+	SegmentSize int64  // A new segment file is started when the current one reaches this size
+	MaxBytes    int64  // Events are rejected when the segments of an event type reach this size, 0 for unlimited
+	Sync        bool   // fsync before accepting events, otherwise they only survive if the process dies (but not the OS)
+}
+
+const (
+	DEFAULT_SPOOL_SEGMENT_SIZE = 16 << 20 // 16 MiB
+	SPOOL_SEGMENT_EXT          = ".wal"
+	SPOOL_HEADER_SIZE          = 8         // Length and CRC32C of each record
+	MAX_SPOOL_RECORD_SIZE      = 256 << 20 // Anything larger is corrupt
+)
+
+var (
+	errSpoolFull       = errors.New("Spool is full")
+	errSpoolClosed     = errors.New("Spool is closed")
+	errSpoolIncomplete = errors.New("Incomplete record")
+	errSpoolCorrupt    = errors.New("Corrupt record")
+)
+
+var spoolCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spoolRecord is the encoded form of an EventRecord
+type spoolRecord struct {
+	Name     string
+	Received int64
+	Data     map[string]interface{}
+}
+
+func init() {
+	// Types of param values, so that they can be gob encoded as interface{}
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register([]string{})
+	gob.Register(json.Number(""))
+}
+
+// Spool persists the events of an event type in segment files before they're accepted, and delivers them to the Sink in the background.
+// Segments are deleted after all of their records are enqueued and the Sink is flushed. Segments left over from the last run are delivered first.
+type Spool struct {
+	Config *SpoolConfig
+	Name   string
+	Logger log.Logger
+
+	dir string
+
+	mu       sync.Mutex // Protects the writer
+	f        *os.File   // Current segment
+	segments []uint64   // Segment numbers, the last one is the current segment
+	size     int64      // Size of the current segment
+	total    int64      // Size of all segments
+	written  int64      // Bytes written since start, for group commit
+	closed   bool
+
+	syncMu sync.Mutex // Serializes fsyncs
+	synced int64      // written at the last fsync
+
+	sinkMu sync.Mutex // Held while a record is being delivered
+	sink   Sink
+
+	notify  chan struct{} // Wakes up the delivery loop
+	closing chan struct{} // Closed by Close, the delivery loop exits when all records are delivered
+	done    chan struct{} // Closed when the delivery loop exits
+}
+
+func NewSpool(c *SpoolConfig, name string, sink Sink, l log.Logger) (*Spool, error) {
+	sp := &Spool{
+		Config:  c,
+		Name:    name,
+		Logger:  l,
+		dir:     filepath.Join(c.Dir, name),
+		sink:    sink,
+		notify:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := os.MkdirAll(sp.dir, os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// Leftovers of the last run
+	files, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), SPOOL_SEGMENT_EXT) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), SPOOL_SEGMENT_EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		sp.segments = append(sp.segments, n)
+		sp.total += fi.Size()
+	}
+	sort.Slice(sp.segments, func(i, j int) bool { return sp.segments[i] < sp.segments[j] })
+	if sp.total > 0 {
+		l.Infof("Spool %s: replaying %d bytes in %d segments", name, sp.total, len(sp.segments))
+	}
+
+	// Never append to old segments, they might end with a partial record
+	if err := sp.openSegment(); err != nil {
+		return nil, err
+	}
+
+	go sp.run()
+	return sp, nil
+}
+
+func (sp *Spool) segmentPath(n uint64) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%016d%s", n, SPOOL_SEGMENT_EXT))
+}
+
+// openSegment starts the next segment, mu should be held
+func (sp *Spool) openSegment() error {
+	var n uint64 = 1
+	if len(sp.segments) > 0 {
+		n = sp.segments[len(sp.segments)-1] + 1
+	}
+	f, err := os.OpenFile(sp.segmentPath(n), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if sp.Config.Sync {
+		if err := syncDir(sp.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	sp.f = f
+	sp.size = 0
+	sp.segments = append(sp.segments, n)
+	return nil
+}
+
+// closeSegment closes the current segment, mu should be held
+func (sp *Spool) closeSegment() error {
+	var err error
+	if sp.Config.Sync {
+		err = sp.f.Sync()
+	}
+	if cerr := sp.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Append persists the record. The event can be accepted when it returns nil.
+func (sp *Spool) Append(r *EventRecord) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, SPOOL_HEADER_SIZE))
+	if err := gob.NewEncoder(&buf).Encode(&spoolRecord{r.name, r.tsReceived, r.data}); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)-SPOOL_HEADER_SIZE))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.Checksum(b[SPOOL_HEADER_SIZE:], spoolCRCTable))
+
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		return errSpoolClosed
+	}
+	if sp.Config.MaxBytes > 0 && sp.total+int64(len(b)) > sp.Config.MaxBytes {
+		sp.mu.Unlock()
+		return errSpoolFull
+	}
+	if sp.size >= sp.segmentSize() {
+		if err := sp.rotate(); err != nil {
+			sp.mu.Unlock()
+			return err
+		}
+	}
+	n, err := sp.f.Write(b)
+	sp.size += int64(n)
+	sp.total += int64(n)
+	if err != nil {
+		// Might be a partial record, which is skipped at the end of a segment
+		sp.rotate()
+		sp.mu.Unlock()
+		return err
+	}
+	sp.written += int64(n)
+	pos := sp.written
+	sp.mu.Unlock()
+
+	if sp.Config.Sync {
+		if err := sp.syncTo(pos); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case sp.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate closes the current segment and starts a new one, mu should be held
+func (sp *Spool) rotate() error {
+	if err := sp.closeSegment(); err != nil {
+		sp.Logger.Errorf("Spool %s: could not close segment: %v", sp.Name, err)
+	}
+	return sp.openSegment()
+}
+
+func (sp *Spool) segmentSize() int64 {
+	if sp.Config.SegmentSize <= 0 {
+		return DEFAULT_SPOOL_SEGMENT_SIZE
+	}
+	return sp.Config.SegmentSize
+}
+
+// syncTo fsyncs the current segment, unless another call already synced past pos (group commit)
+func (sp *Spool) syncTo(pos int64) error {
+	sp.syncMu.Lock()
+	defer sp.syncMu.Unlock()
+	if sp.synced >= pos {
+		return nil
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err := sp.f.Sync(); err != nil {
+		return err
+	}
+	sp.synced = sp.written
+	return nil
+}
+
+// setSink replaces the Sink records are delivered to, when the registry is reloaded
+func (sp *Spool) setSink(sink Sink) {
+	sp.sinkMu.Lock()
+	defer sp.sinkMu.Unlock()
+	if sp.sink == sink {
+		return
+	}
+	// The old one is closed by the registry, but make sure delivered records are written before a segment is deleted
+	if err := sp.sink.Flush(); err != nil {
+		sp.Logger.Errorf("Spool %s: could not flush the old sink: %v", sp.Name, err)
+	}
+	sp.sink = sink
+}
+
+// Close stops accepting records and delivers the rest. If the sink is failing, the rest stays in the spool until the next start.
+func (sp *Spool) Close() error {
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		return nil
+	}
+	sp.closed = true
+	err := sp.closeSegment()
+	sp.mu.Unlock()
+
+	close(sp.closing)
+	<-sp.done
+	return err
+}
+
+// Size returns the size of all segments in bytes
+func (sp *Spool) Size() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.total
+}
+
+// run is the delivery loop
+func (sp *Spool) run() {
+	defer close(sp.done)
+
+	var (
+		seg    uint64
+		f      *os.File
+		offset int64
+	)
+	for {
+		sp.mu.Lock()
+		if len(sp.segments) == 0 {
+			sp.mu.Unlock()
+			return // Closed and everything is delivered
+		}
+		finished := len(sp.segments) > 1 || sp.closed
+		if f == nil {
+			seg = sp.segments[0]
+			offset = 0
+		}
+		sp.mu.Unlock()
+
+		if f == nil {
+			var err error
+			if f, err = os.Open(sp.segmentPath(seg)); err != nil {
+				sp.Logger.Errorf("Spool %s: could not open segment %d: %v", sp.Name, seg, err)
+				if !sp.wait(RETRY_MAX_BACKOFF) {
+					return
+				}
+				continue
+			}
+		}
+
+		r, n, err := readSpoolRecord(f, offset)
+		if err == nil {
+			if !sp.deliver(r) {
+				f.Close()
+				return // Closing while the sink is failing
+			}
+			offset += n
+			continue
+		}
+
+		if err != errSpoolIncomplete && err != errSpoolCorrupt {
+			sp.Logger.Errorf("Spool %s: could not read segment %d: %v", sp.Name, seg, err)
+			if !sp.wait(RETRY_MAX_BACKOFF) {
+				f.Close()
+				return
+			}
+			continue
+		}
+		if !finished {
+			if err == errSpoolCorrupt {
+				// Shouldn't happen, but don't keep writing after it
+				sp.Logger.Errorf("Spool %s: corrupt record in the current segment %d at %d", sp.Name, seg, offset)
+				sp.mu.Lock()
+				if sp.segments[len(sp.segments)-1] == seg && !sp.closed {
+					sp.rotate()
+				}
+				sp.mu.Unlock()
+				continue
+			}
+			// Wait for the next record. If the spool is closed, the segment is finished now.
+			sp.wait(0)
+			continue
+		}
+
+		if err == errSpoolCorrupt {
+			sp.Logger.Errorf("Spool %s: corrupt record in segment %d at %d, skipping the rest of the segment", sp.Name, seg, offset)
+		} else if fi, serr := f.Stat(); serr == nil && fi.Size() > offset {
+			sp.Logger.Warningf("Spool %s: skipping partial record at the end of segment %d", sp.Name, seg)
+		}
+
+		// All records of the segment are delivered, delete it once they're written
+		if !sp.flush() {
+			f.Close()
+			return
+		}
+		f.Close()
+		f = nil
+		sp.removeSegment(seg)
+	}
+}
+
+// wait waits for a notification, or the timeout if it's not 0. Returns false if the spool is closing.
+func (sp *Spool) wait(timeout time.Duration) bool {
+	var t <-chan time.Time
+	if timeout > 0 {
+		t = time.After(timeout)
+	}
+	select {
+	case <-sp.notify:
+		return true
+	case <-t:
+		return true
+	case <-sp.closing:
+		return false
+	}
+}
+
+// retry calls f with a backoff until it succeeds. Gives up and returns false if the spool is closing.
+func (sp *Spool) retry(what string, f func() error) bool {
+	backoff := RETRY_MIN_BACKOFF
+	for {
+		err := f()
+		if err == nil {
+			return true
+		}
+
+		select {
+		case <-sp.closing:
+			sp.Logger.Errorf("Spool %s: could not %s: %v, keeping %d bytes in the spool", sp.Name, what, err, sp.Size())
+			return false
+		default:
+		}
+		sp.Logger.Debugf("Spool %s: could not %s: %v, retrying in %v", sp.Name, what, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-sp.closing:
+		}
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+func (sp *Spool) deliver(r *EventRecord) bool {
+	return sp.retry("deliver record", func() error {
+		sp.sinkMu.Lock()
+		defer sp.sinkMu.Unlock()
+		return sp.sink.Enqueue(r)
+	})
+}
+
+func (sp *Spool) flush() bool {
+	return sp.retry("flush the sink", func() error {
+		sp.sinkMu.Lock()
+		defer sp.sinkMu.Unlock()
+		return sp.sink.Flush()
+	})
+}
+
+func (sp *Spool) removeSegment(seg uint64) {
+	path := sp.segmentPath(seg)
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
+	}
+	if err := os.Remove(path); err != nil {
+		sp.Logger.Errorf("Spool %s: could not remove segment %d: %v", sp.Name, seg, err)
+	}
+
+	sp.mu.Lock()
+	sp.segments = sp.segments[1:]
+	sp.total -= size
+	sp.mu.Unlock()
+}
+
+// readSpoolRecord reads the record at offset, and returns its size in the segment
+func readSpoolRecord(f *os.File, offset int64) (*EventRecord, int64, error) {
+	header := make([]byte, SPOOL_HEADER_SIZE)
+	if _, err := f.ReadAt(header, offset); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, errSpoolIncomplete
+	} else if err != nil {
+		return nil, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size == 0 || size > MAX_SPOOL_RECORD_SIZE {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, offset+SPOOL_HEADER_SIZE); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, errSpoolIncomplete
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, spoolCRCTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	var sr spoolRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&sr); err != nil {
+		return nil, 0, errSpoolCorrupt
+	}
+	return &EventRecord{name: sr.Name, tsReceived: sr.Received, data: sr.Data}, SPOOL_HEADER_SIZE + int64(size), nil
+}
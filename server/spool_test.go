@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"github.com/alexcesaro/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testSink keeps the records it's given, or fails if err is set
+type testSink struct {
+	mu      sync.Mutex
+	err     error
+	records []*EventRecord
+	flushed int // Records at the last Flush
+}
+
+func (s *testSink) Enqueue(r *EventRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.flushed = len(s.records)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return s.Flush()
+}
+
+func (s *testSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func testSpoolRecords(n int) []*EventRecord {
+	records := make([]*EventRecord, n)
+	for i := range records {
+		records[i] = &EventRecord{name: "test", tsReceived: int64(1000 + i), data: map[string]interface{}{"i": string(rune('a' + i))}}
+	}
+	return records
+}
+
+// leaveSpool appends the records while the sink is failing, so they're left in a segment file for the next start. Returns its path.
+func leaveSpool(t *testing.T, c *SpoolConfig, records []*EventRecord) string {
+	sp, err := NewSpool(c, "test", &testSink{err: errors.New("failing")}, log.NullLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := sp.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := sp.segmentPath(1)
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Fatalf("records should be left in %s: %v", path, err)
+	}
+	return path
+}
+
+func TestSpoolReplay(t *testing.T) {
+	records := testSpoolRecords(3)
+
+	tests := []struct {
+		name    string
+		damage  func(data []byte) []byte
+		records int
+	}{
+		{"intact", func(data []byte) []byte { return data }, 3},
+		{"truncated final record", func(data []byte) []byte { return data[:len(data)-5] }, 2},
+		{"truncated final header", func(data []byte) []byte { return append(data, 42, 0, 0) }, 3},
+		{"corrupt record", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &SpoolConfig{Dir: t.TempDir(), Sync: true}
+			path := leaveSpool(t, c, records)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, tt.damage(data), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			sink := &testSink{}
+			sp, err := NewSpool(c, "test", sink, log.NullLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sp.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(sink.records, records[:tt.records]) {
+				t.Errorf("delivered %v, should be %v", sink.records, records[:tt.records])
+			}
+			if sink.flushed != tt.records {
+				t.Errorf("%d records were flushed, should be %d", sink.flushed, tt.records)
+			}
+			if left, _ := filepath.Glob(filepath.Join(c.Dir, "test", "*"+SPOOL_SEGMENT_EXT)); len(left) > 0 {
+				t.Errorf("segments %q should have been removed", left)
+			}
+			if sp.Size() != 0 {
+				t.Errorf("size is %d, should be 0", sp.Size())
+			}
+		})
+	}
+}
+
+// New records go to a new segment after a restart, not after the partial record
+func TestSpoolAppendAfterTruncated(t *testing.T) {
+	records := testSpoolRecords(4)
+	c := &SpoolConfig{Dir: t.TempDir()}
+	path := leaveSpool(t, c, records[:2])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data[:len(data)-1], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &testSink{}
+	sp, err := NewSpool(c, "test", sink, log.NullLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records[2:] {
+		if err := sp.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*EventRecord{records[0], records[2], records[3]}
+	if !reflect.DeepEqual(sink.records, want) {
+		t.Errorf("delivered %v, should be %v", sink.records, want)
+	}
+}
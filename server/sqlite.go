@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const SINK_TYPE_SQLITE = "sqlite"
+
+// SQLiteConfig is the destination of a sqlite sink
+type SQLiteConfig struct {
+	Database  string   `json:"database" yaml:"database"`     // File under datadir, shared by the sinks which use the same file
+	Table     string   `json:"table" yaml:"table"`           // {event} is replaced with the event type. Without {event}, event types share the table.
+	BatchSize int      `json:"batch_size" yaml:"batch_size"` // Max records in a transaction
+	Linger    Duration `json:"linger" yaml:"linger"`         // How long to wait for a batch to fill up
+}
+
+func (c *SQLiteConfig) validate() error {
+	if c.Database != "" {
+		if filepath.IsAbs(c.Database) {
+			return fmt.Errorf("database: should be relative to datadir")
+		}
+		if err := checkPathComponents(c.Database); err != nil {
+			return fmt.Errorf("database: %v", err)
+		}
+	}
+	if c.Table != "" && !eventNameRegexp.MatchString(strings.Replace(c.Table, "{event}", "event", -1)) {
+		return fmt.Errorf("table: should only contain letters, digits, '_', '.', '-' and {event}, and not start with '.'")
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size: can't be negative")
+	}
+	return nil
+}
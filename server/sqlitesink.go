@@ -0,0 +1,210 @@
+//go:build sqlite
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/alexcesaro/log"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SQLITE_DATABASE   = "events.db"
+	DEFAULT_SQLITE_TABLE      = "{event}"
+	DEFAULT_SQLITE_BATCH_SIZE = 1000
+	DEFAULT_SQLITE_LINGER     = 100 * time.Millisecond
+	SQLITE_BUSY_TIMEOUT       = 5 * time.Second
+)
+
+func init() {
+	RegisterSink(SINK_TYPE_SQLITE, newSQLiteSink)
+}
+
+// sqliteDBs are the open databases by path, so sinks writing to the same file share the connection
+var sqliteDBs = struct {
+	sync.Mutex
+	m map[string]*sqliteDB
+}{m: make(map[string]*sqliteDB)}
+
+type sqliteDB struct {
+	*sql.DB
+	path string
+	refs int
+}
+
+func openSQLite(path string) (*sqliteDB, error) {
+	sqliteDBs.Lock()
+	defer sqliteDBs.Unlock()
+	if db, ok := sqliteDBs.m[path]; ok {
+		db.refs++
+		return db, nil
+	}
+
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=%d", path, SQLITE_BUSY_TIMEOUT/time.Millisecond)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // One writer at a time anyway
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqliteDB{DB: db, path: path, refs: 1}
+	sqliteDBs.m[path] = s
+	return s, nil
+}
+
+func (db *sqliteDB) release() error {
+	sqliteDBs.Lock()
+	defer sqliteDBs.Unlock()
+	if db.refs--; db.refs > 0 {
+		return nil
+	}
+	delete(sqliteDBs.m, db.path)
+	return db.Close()
+}
+
+// SQLiteSink inserts each record as a row into a SQLite table, with the columns id, received (timestamp in nanoseconds), event, ts and data (JSON).
+// Records are inserted in transactions of up to BatchSize records by a worker, which retries failed transactions with a backoff. While it's failing, events are rejected like with a failing Storage.
+type SQLiteSink struct {
+	Config SQLiteConfig
+	Logger log.Logger
+	db     *sqliteDB
+	insert string
+	queue  *sinkQueue
+	done   chan struct{}
+}
+
+func newSQLiteSink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	var sc SQLiteConfig
+	if c.SQLite != nil {
+		sc = *c.SQLite
+	}
+	if sc.Database == "" {
+		sc.Database = DEFAULT_SQLITE_DATABASE
+	}
+	sc.Database = filepath.Join(c.DataDir, sc.Database)
+	if sc.Table == "" {
+		sc.Table = DEFAULT_SQLITE_TABLE
+	}
+	sc.Table = strings.Replace(sc.Table, "{event}", e.Name, -1)
+	if sc.BatchSize == 0 {
+		sc.BatchSize = DEFAULT_SQLITE_BATCH_SIZE
+	}
+	if sc.Linger == 0 {
+		sc.Linger = Duration(DEFAULT_SQLITE_LINGER)
+	}
+
+	db, err := openSQLite(sc.Database)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open %s: %v", sc.Database, err)
+	}
+	table := `"` + sc.Table + `"`
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		id INTEGER PRIMARY KEY,
+		received INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		ts INTEGER,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS "` + sc.Table + `_received" ON ` + table + ` (received)`)
+	if err != nil {
+		db.release()
+		return nil, fmt.Errorf("Could not create table %s in %s: %v", sc.Table, sc.Database, err)
+	}
+
+	s := &SQLiteSink{
+		Config: sc,
+		Logger: l,
+		db:     db,
+		insert: `INSERT INTO ` + table + ` (received, event, ts, data) VALUES (?, ?, ?, ?)`,
+		queue:  newSinkQueue(c),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *SQLiteSink) run() {
+	defer close(s.done)
+	s.queue.run(s.Config.BatchSize, time.Duration(s.Config.Linger), s.send)
+}
+
+// send inserts the records in a transaction, retrying it until it's committed or the sink is closed
+func (s *SQLiteSink) send(records []*EventRecord) error {
+	type row struct {
+		received int64
+		event    string
+		ts       interface{}
+		data     string
+	}
+	rows := make([]row, 0, len(records))
+	for _, r := range records {
+		data, err := json.Marshal(r.data)
+		if err != nil {
+			s.Logger.Errorf("Could not encode %s: %v", r, err)
+			continue
+		}
+		rows = append(rows, row{r.tsReceived, r.name, r.data["ts"], string(data)})
+	}
+
+	err := s.queue.retry(fmt.Sprintf("Inserting into %s in %s", s.Config.Table, s.Config.Database), s.Logger, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(s.insert)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, r := range rows {
+			if _, err := stmt.Exec(r.received, r.event, r.ts, r.data); err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return err
+			}
+		}
+		stmt.Close()
+		return tx.Commit()
+	})
+	if err != nil {
+		s.Logger.Errorf("Lost %d records of %s", len(rows), s.Config.Table)
+	}
+	return err
+}
+
+func (s *SQLiteSink) Enqueue(r *EventRecord) error {
+	return s.queue.enqueue(r)
+}
+
+// Flush inserts the queued records, and returns after they're committed
+func (s *SQLiteSink) Flush() error {
+	return s.queue.flush()
+}
+
+// Close inserts the rest of the queue, trying once if the database is failing
+func (s *SQLiteSink) Close() error {
+	s.queue.close()
+	<-s.done
+	err := s.queue.health()
+	if cerr := s.db.release(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *SQLiteSink) Health() error {
+	return s.queue.health()
+}
+
+func (s *SQLiteSink) QueueDepth() (depth, size int) {
+	return s.queue.QueueDepth()
+}
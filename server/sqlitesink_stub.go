@@ -0,0 +1,8 @@
+//go:build !sqlite
+
+package server
+
+// go-sqlite3 needs cgo, so the sqlite sink is only built with the sqlite tag
+func init() {
+	registerUnavailableSink(SINK_TYPE_SQLITE, "sqlite sinks need a binary built with -tags sqlite")
+}
@@ -1,131 +1,1039 @@
 package server
 
 import (
-	"encoding/csv"
-	"encoding/json"
+	"container/list"
+	"errors"
 	"fmt"
 	"github.com/alexcesaro/log"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type StorageConfig struct {
-	DataDir string
+	DataDir      string
+	Path         string        // Path template of the files under DataDir, see ParsePathTemplate
+	Format       string        // One of the STORAGE_FORMAT_ constants
+	Compression  string        // One of the COMPRESSION_ constants
+	Partition    string        // One of the PARTITION_ constants
+	MaxOpenFiles int           // Files kept open at the same time, the least recently used one is closed first
+	IdleClose    time.Duration // Close files which haven't been written to for this long, 0 to disable
+
+	// Rotation thresholds, a new file with the next {seq} is started when one of them is reached. 0 to disable.
+	MaxBytes   int64         // Bytes written to the file (after compression)
+	MaxRecords int64         // Records written to the file
+	MaxAge     time.Duration // Time since the file was opened
+
+	Finalize string // One of the FINALIZE_ constants
+
+	// Retention of the closed files, expired files are removed (or moved to ArchiveDir) in the background. 0 to disable.
+	Retention       time.Duration // Time since the end of the period (ie. the hour) of the file
+	RetentionBytes  int64         // Total size of the files, the oldest ones are expired above it
+	ArchiveDir      string        // Expired files are moved here (with the same path under it) instead of removed
+	RetentionDryRun bool          // Only log the files which would be expired
+
+	Durability   string        // One of the DURABILITY_ constants
+	SyncInterval time.Duration // For DURABILITY_PERIODIC
+
+	QueueSize    int           // Records waiting for the worker
+	QueueFull    string        // One of the QUEUE_FULL_ constants
+	QueueTimeout time.Duration // For QUEUE_FULL_BLOCK
+
+	Redis *redis.Pool // Of the stats, used by redis sinks
 }
 
+// What Enqueue does when the queue is full
+const (
+	QUEUE_FULL_BLOCK  = "block"  // Wait for QueueTimeout, then reject
+	QUEUE_FULL_REJECT = "reject" // Reject immediately
+)
+
+const (
+	DEFAULT_QUEUE_SIZE    = 1000
+	DEFAULT_QUEUE_TIMEOUT = time.Second
+)
+
+var (
+	errQueueFull      = errors.New("Queue is full")
+	errStorageStopped = errors.New("Storage is stopped")
+)
+
+// When written records are flushed and fsynced
+const (
+	DURABILITY_NONE     = "none"     // When the file is closed, buffered records are lost if the process dies
+	DURABILITY_PERIODIC = "periodic" // Every SyncInterval
+	DURABILITY_SYNC     = "sync"     // Before Enqueue returns, so events are only accepted after they're on disk
+)
+
+// Backoff of retries while the storage is failing
+const (
+	RETRY_MIN_BACKOFF = 100 * time.Millisecond
+	RETRY_MAX_BACKOFF = 30 * time.Second
+)
+
+const (
+	DEFAULT_SYNC_INTERVAL = time.Second
+	MAX_GROUP_COMMIT      = 1000 // Records synced at once in DURABILITY_SYNC mode
+)
+
+// How closed files are marked as complete
+const (
+	FINALIZE_NONE   = "none"   // Files might be appended to later
+	FINALIZE_DONE   = "done"   // An empty <file>.done marker is created next to the closed file
+	FINALIZE_RENAME = "rename" // Files are written as <file>.inprogress, and renamed when closed
+)
+
+const (
+	DONE_SUFFIX       = ".done"
+	INPROGRESS_SUFFIX = ".inprogress"
+)
+
+const (
+	PARTITION_RECEIVED = "received" // Files are determined by the time the event is received
+	PARTITION_EVENT    = "event"    // Files are determined by the validated ts of the event
+)
+
+// Defaults for PARTITION_EVENT. With PARTITION_RECEIVED there's only one file open at a time, which is closed when the hour changes.
+const (
+	DEFAULT_EVENT_PARTITION_MAX_OPEN_FILES = ALLOWED_PAST_TIME_IN_SECONDS/3600 + 1
+	DEFAULT_EVENT_PARTITION_IDLE_CLOSE     = 5 * time.Minute
+)
+
+// Storage is the file Sink, writing records to local files
 type Storage struct {
 	Config  *StorageConfig
+	Schema  *Schema // Declared params of the event type, used by the parquet format
 	Logger  log.Logger
+	path    *PathTemplate
+	closed  func(path string) // Optional, called by the worker with the path of each file which was closed without errors
+	nfa     *pathNFA          // Matches the files of the storage, to finalize the ones left over from the last run and to expire old ones
+	periods *pathPeriods      // Parses the period of the files from their paths, nil if the path template has no date
+	checked map[string]bool   // Existing files which were repaired (or found intact) before appending to them, used by the worker only
 	wg      sync.WaitGroup
-	records chan *EventRecord
+	records chan storageItem
+	stop    chan struct{}   // Closed by Stop, so that retries give up
+	done    chan struct{}   // Closed when the worker exits
+	after   []chan struct{} // Workers of the Storages which can write the same files, ie. the one being replaced on reload. Waited for before writing.
+
+	sendMu  sync.RWMutex // Held for reading while sending to records, so that Stop doesn't close it meanwhile
+	stopped bool
+
+	mu      sync.Mutex
+	err     error         // Last error while failing, nil if healthy
+	failing chan struct{} // Closed when the storage starts failing, to wake up blocked Enqueue calls
+}
+
+const SINK_TYPE_FILE = "file"
+
+func init() {
+	RegisterSink(SINK_TYPE_FILE, newFileSink)
+}
+
+func newFileSink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	s, err := newFileStorage(e, c, l)
+	if err != nil {
+		return nil, err
+	}
+	s.RunInBackground()
+	return s, nil
+}
+
+// newFileStorage creates the Storage of a sink, without starting it
+func newFileStorage(e *EventType, c *EventStorageConfig, l log.Logger) (*Storage, error) {
+	sc := c.fileStorageConfig()
+	path, err := fileSinkPath(sc)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := filepath.Abs(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewStorage(sc, l)
+	s.Schema = e.Schema
+	s.path = path
+	s.nfa = fileSinkNFA(path, dir, e.Name, c)
+	s.periods = path.periods(dir+string(filepath.Separator), fileSinkValues(e.Name, c))
+	return s, nil
+}
+
+func (c *EventStorageConfig) fileStorageConfig() *StorageConfig {
+	return &StorageConfig{
+		DataDir:         c.DataDir,
+		Path:            c.Path,
+		Format:          c.Format,
+		Compression:     c.Compression,
+		Partition:       c.Partition,
+		MaxOpenFiles:    c.MaxOpenFiles,
+		IdleClose:       time.Duration(c.IdleClose),
+		MaxBytes:        c.MaxBytes,
+		MaxRecords:      c.MaxRecords,
+		MaxAge:          time.Duration(c.MaxAge),
+		Finalize:        c.Finalize,
+		Retention:       time.Duration(c.Retention),
+		RetentionBytes:  c.RetentionBytes,
+		ArchiveDir:      c.ArchiveDir,
+		RetentionDryRun: c.RetentionDryRun,
+		Durability:      c.Durability,
+		SyncInterval:    time.Duration(c.SyncInterval),
+		QueueSize:       c.QueueSize,
+		QueueFull:       c.QueueFull,
+		QueueTimeout:    time.Duration(c.QueueTimeout),
+	}
+}
+
+// appendable tells if existing files are appended to. Otherwise a new file is started each time.
+func (c *StorageConfig) appendable() bool {
+	return storageFormats[c.Format].appendable && c.Finalize == FINALIZE_NONE && !c.rotates()
+}
+
+func (c *StorageConfig) rotates() bool {
+	return c.MaxBytes > 0 || c.MaxRecords > 0 || c.MaxAge > 0
+}
+
+// fileSinkPath returns the path template used by the file sink
+func fileSinkPath(c *StorageConfig) (*PathTemplate, error) {
+	p, err := ParsePathTemplate(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !c.appendable() {
+		p = p.withSeq()
+	}
+	return p, nil
+}
+
+// checkFilePaths returns an error if two file sinks (of the same or different event types) could write to the same file,
+// or if a sink archives files into the data directory of a sink
+func checkFilePaths(ec *EventsConfig, configs [][]*EventStorageConfig) error {
+	type fileSink struct {
+		field        string
+		nfa          *pathNFA
+		dir, archive string // Absolute
+	}
+	var seen []fileSink
+	for i, sinks := range configs {
+		name := ec.Events[i].Name
+		for j, c := range sinks {
+			if !c.stagesFiles() {
+				continue
+			}
+			field := fmt.Sprintf("events[%d] (%s): %s", i, name, ec.Events[i].sinkField(j))
+			p, err := fileSinkPath(c.fileStorageConfig())
+			if err != nil {
+				return fmt.Errorf("%s.path: %v", field, err)
+			}
+			dir, err := filepath.Abs(c.DataDir)
+			if err != nil {
+				return fmt.Errorf("%s.datadir: %v", field, err)
+			}
+			nfa := fileSinkNFA(p, dir, name, c)
+			archive := ""
+			if c.ArchiveDir != "" {
+				if archive, err = filepath.Abs(c.ArchiveDir); err != nil {
+					return fmt.Errorf("%s.archive_dir: %v", field, err)
+				}
+			}
+
+			for _, o := range seen {
+				if path, ok := o.nfa.intersect(nfa); ok {
+					return fmt.Errorf("%s.path: can write to the same file as %s, ie. %s", field, o.field, path)
+				}
+			}
+			seen = append(seen, fileSink{field, nfa, dir, archive})
+		}
+	}
+
+	// The storage files would be appended to the dead-letter files, or the other way around
+	for i, sinks := range configs {
+		for j, c := range sinks {
+			if c.Type != SINK_TYPE_WEBHOOK {
+				continue
+			}
+			path, err := filepath.Abs(c.deadLetterPath(ec.Events[i].Name))
+			if err != nil {
+				return err
+			}
+			for _, o := range seen {
+				if o.nfa.match(path) {
+					return fmt.Errorf("events[%d] (%s): %s.webhook.dead_letter: %s is a file of %s", i, ec.Events[i].Name, ec.Events[i].sinkField(j), path, o.field)
+				}
+			}
+		}
+	}
+
+	// Archived files would still be counted (and expired again) by the sinks of the data directory
+	for _, s := range seen {
+		for _, o := range seen {
+			if s.archive == "" || (s.archive != o.dir && !strings.HasPrefix(s.archive, o.dir+string(filepath.Separator))) {
+				continue
+			}
+			if o.field == s.field {
+				return fmt.Errorf("%s.archive_dir: should be outside of the datadir (%s)", s.field, o.dir)
+			}
+			return fmt.Errorf("%s.archive_dir: should be outside of the datadir of %s (%s)", s.field, o.field, o.dir)
+		}
+	}
+	return nil
+}
+
+// checkDurability returns an error if a sink writes Parquet files with sync durability, as every sync would write a row group
+func checkDurability(ec *EventsConfig, configs [][]*EventStorageConfig) error {
+	for i, sinks := range configs {
+		for j, c := range sinks {
+			if c.stagesFiles() && c.Format == STORAGE_FORMAT_PARQUET && c.Durability == DURABILITY_SYNC {
+				return fmt.Errorf("events[%d] (%s): %s.durability: %s can't be used with the %s format, use %s", i, ec.Events[i].Name, ec.Events[i].sinkField(j), DURABILITY_SYNC, STORAGE_FORMAT_PARQUET, DURABILITY_PERIODIC)
+			}
+		}
+	}
+	return nil
 }
 
-// One of these two constants should have {event} in it, otherwise multiple Storage instances will try to write to the same file. Which is never good.
-const DIRECTORY_FORMAT = "2006/01/02/" // Trailing slash!
-const FILE_FORMAT = "15_{event}.tsv"
+// fileSinkNFA matches the files the sink can write under the absolute dir
+func fileSinkNFA(p *PathTemplate, dir, event string, c *EventStorageConfig) *pathNFA {
+	return p.nfa(dir+string(filepath.Separator), fileSinkValues(event, c))
+}
+
+// fileSinkValues are the values of the tokens which are the same for all files of the sink
+func fileSinkValues(event string, c *EventStorageConfig) *pathValues {
+	return &pathValues{
+		event: event,
+		host:  hostname,
+		ext:   fileExt(c.Format, c.Compression),
+	}
+}
 
 func NewStorage(c *StorageConfig, l log.Logger) (s *Storage) {
 
 	s = &Storage{
 		Config:  c,
 		Logger:  l,
-		records: make(chan *EventRecord),
+		checked: make(map[string]bool),
+		records: make(chan storageItem, c.queueSize()),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		failing: make(chan struct{}),
 	}
 	return
 }
 
+// liveStorages are the Storages with running workers
+var liveStorages = struct {
+	sync.Mutex
+	m map[*Storage]bool
+}{m: make(map[*Storage]bool)}
+
 func (s *Storage) RunInBackground() {
+	liveStorages.Lock()
+	for o := range liveStorages.m {
+		if s.nfa == nil || o.nfa == nil {
+			continue
+		}
+		if _, ok := o.nfa.intersect(s.nfa); ok {
+			s.after = append(s.after, o.done)
+		}
+	}
+	liveStorages.m[s] = true
+	liveStorages.Unlock()
+	if s.Config.retains() {
+		wakeJanitor()
+	}
+
+	s.wg.Add(1)
 	go func() {
 		s.Run()
 	}()
 }
 
 func (s *Storage) Stop() {
+	close(s.stop)
+	s.sendMu.Lock()
+	s.stopped = true
 	close(s.records)
+	s.sendMu.Unlock()
 	s.wg.Wait()
 }
 
+func (s *Storage) Close() error {
+	s.Stop()
+	return nil
+}
+
+// Flush writes the queued records and the buffered records of the open files
+func (s *Storage) Flush() error {
+	s.mu.Lock()
+	err, failing := s.err, s.failing
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan error, 1)
+	s.sendMu.RLock()
+	if s.stopped {
+		s.sendMu.RUnlock()
+		return errStorageStopped
+	}
+	select {
+	case s.records <- storageItem{flush: ch}:
+	case <-failing:
+		s.sendMu.RUnlock()
+		return s.Health()
+	case <-s.stop:
+		s.sendMu.RUnlock()
+		return errStorageStopped
+	}
+	s.sendMu.RUnlock()
+	select {
+	case err = <-ch:
+		return err
+	case <-failing:
+		return s.Health()
+	}
+}
+
+func (s *Storage) QueueDepth() (depth, size int) {
+	return len(s.records), cap(s.records)
+}
+
+func (s *Storage) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// setHealth is called by the worker after each operation
+func (s *Storage) setHealth(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil && s.err == nil {
+		close(s.failing)
+	} else if err == nil && s.err != nil {
+		s.failing = make(chan struct{})
+		s.Logger.Infof("Storage %s recovered", s.Config.DataDir)
+	}
+	s.err = err
+}
+
+// storageFile is an open output file
+type storageFile struct {
+	name      string // Path determined from the record
+	path      string // Actual path, might have a different {seq} if the file is not appended to
+	seq       int
+	writePath string // path with INPROGRESS_SUFFIX if the file is renamed when closed
+	damaged   bool   // A write failed, so the file might end with a partial record
+	finalize  string
+	f         *os.File
+	size      *countingWriter
+	cw        compressWriter // nil if not compressed
+	rw        recordWriter
+	opened    time.Time
+	lastUsed  time.Time
+	records   int64
+	fsync     bool // Sync before closing
+	dirty     bool // Written to since the last sync
+}
+
+// States of a storageItem with done
+const (
+	ITEM_QUEUED    = 0
+	ITEM_TAKEN     = 1
+	ITEM_WITHDRAWN = 2
+)
+
+type storageItem struct {
+	r     *EventRecord
+	done  chan error // Set in DURABILITY_SYNC mode, receives the result of the sync
+	taken *int32     // Set with done, ITEM_TAKEN once the worker writes the record, or ITEM_WITHDRAWN if Enqueue gave up on it before
+	flush chan error // Set for Flush calls instead of r, receives the result of the flush
+}
+
+// openFiles keeps the open files of a Storage worker, least recently used first to be closed
+type openFiles struct {
+	byName map[string]*list.Element
+	lru    *list.List // Most recently used at the front
+}
+
+func newOpenFiles() *openFiles {
+	return &openFiles{
+		byName: make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+func (o *openFiles) get(name string) *storageFile {
+	if e, ok := o.byName[name]; ok {
+		o.lru.MoveToFront(e)
+		return e.Value.(*storageFile)
+	}
+	return nil
+}
+
+func (o *openFiles) add(sf *storageFile) {
+	o.byName[sf.name] = o.lru.PushFront(sf)
+}
+
+// oldest returns the least recently used file
+func (o *openFiles) oldest() *storageFile {
+	if e := o.lru.Back(); e != nil {
+		return e.Value.(*storageFile)
+	}
+	return nil
+}
+
+func (o *openFiles) remove(sf *storageFile) {
+	if e, ok := o.byName[sf.name]; ok {
+		o.lru.Remove(e)
+		delete(o.byName, sf.name)
+	}
+}
+
+func (o *openFiles) len() int {
+	return o.lru.Len()
+}
+
+// Run should be called using RunInBackground
 func (s *Storage) Run() {
-	s.wg.Add(1)
+	defer close(s.done)
+	defer func() {
+		liveStorages.Lock()
+		delete(liveStorages.m, s)
+		liveStorages.Unlock()
+	}()
+
+	// Two workers appending to the same file would interleave their records. Meanwhile records are queued.
+	for _, done := range s.after {
+		s.Logger.Debugf("Waiting for the previous storage of %s to close its files", s.Config.DataDir)
+		select {
+		case <-done:
+		case <-s.stop: // Not used, ie. the reload failed
+		}
+	}
 
-	var (
-		ofName string
-		of     *os.File
-		err    error
-		cw     *csv.Writer
-	)
-
-	closeOpenFile := func() {
-		if of != nil {
-			cw.Flush()
-			err = cw.Error()
+	s.recoverFiles()
+	files := newOpenFiles()
+	var groupErr error // Of closing files during the group commit, their records aren't synced by it
+	var lost int       // Accepted records which couldn't be written before the storage was stopped
+
+	closeFile := func(sf *storageFile) error {
+		files.remove(sf)
+		err := sf.close()
+		if err == nil && sf.damaged {
+			err = s.repair(sf.path)
+		}
+		if err != nil {
+			s.Logger.Errorf("Could not close file %s: %v", sf.path, err)
+			groupErr = err
+		} else if s.closed != nil {
+			s.closed(sf.path)
+		}
+		return err
+	}
+	closeAll := func() {
+		for sf := files.oldest(); sf != nil; sf = files.oldest() {
+			closeFile(sf)
+		}
+	}
+	flush := func() error {
+		for e := files.lru.Front(); e != nil; e = e.Next() {
+			if err := e.Value.(*storageFile).flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// fsync the files which were written to since the last sync
+	sync := func() error {
+		for e := files.lru.Front(); e != nil; e = e.Next() {
+			if err := e.Value.(*storageFile).sync(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	write := func(r *EventRecord) error {
+		v := s.pathValues(r)
+		filename := s.determineStoragePath(v)
+		of := files.get(filename)
+		if of != nil && s.shouldRotate(of) {
+			s.Logger.Debugf("Rotating %s", of.path)
+			closeFile(of)
+			v.seq = of.seq + 1
+			of = nil
+		}
+		if of == nil { // is our destination file not open yet?
+			for files.len() >= s.maxOpenFiles() {
+				closeFile(files.oldest())
+			}
+
+			var err error
+			of, err = s.openFile(filename, v)
 			if err != nil {
-				s.Logger.Errorf("Could not flush csv file %s: %v", ofName, err)
-				panic(err)
+				return fmt.Errorf("Could not open %s: %v", filename, err)
+			}
+			files.add(of)
+		}
+		of.lastUsed = time.Now()
+
+		if err := of.rw.Write(r); err != nil {
+			// The file might end with a partial record now, it's cut when the file is closed (or the next time it's opened, if closing fails too)
+			delete(s.checked, of.path)
+			of.damaged = true
+			closeFile(of)
+			return fmt.Errorf("Could not write to %s: %v", of.path, err)
+		}
+		of.records++
+		of.dirty = true
+		return nil
+	}
+	// writeWithRetry retries until the record is written, or the storage is stopped
+	writeWithRetry := func(r *EventRecord) error {
+		backoff := RETRY_MIN_BACKOFF
+		for {
+			err := write(r)
+			s.setHealth(err)
+			if err == nil {
+				return nil
+			}
+
+			s.Logger.Errorf("%v, retrying in %v", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				s.Logger.Debugf("Storage is stopped, dropping %s", r)
+				return err
+			}
+			if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+				backoff = RETRY_MAX_BACKOFF
 			}
-			of.Close()
 		}
 	}
-	for r := range s.records {
-		dir, filename := s.determineStoragePath(r)
-		if filename != ofName { // is another file other than our destination file open?
-			closeOpenFile()
-			s.ensureDir(dir)
-			openFlags := os.O_APPEND | os.O_WRONLY
-			if _, err := os.Stat(filename); err != nil {
-				openFlags |= os.O_CREATE
+
+	// Check for idle and old files periodically
+	var idleCheck <-chan time.Time
+	if interval := s.checkInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
+	var syncTick <-chan time.Time
+	if s.Config.Durability == DURABILITY_PERIODIC {
+		ticker := time.NewTicker(s.syncInterval())
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-syncTick:
+			if err := sync(); err != nil {
+				s.Logger.Errorf("Could not sync: %v", err)
+			}
+		case now := <-idleCheck:
+			for e := files.lru.Front(); e != nil; {
+				sf := e.Value.(*storageFile)
+				e = e.Next()
+				if s.Config.IdleClose > 0 && now.Sub(sf.lastUsed) >= s.Config.IdleClose {
+					s.Logger.Debugf("Closing idle file %s", sf.path)
+					closeFile(sf)
+				} else if s.Config.MaxAge > 0 && now.Sub(sf.opened) >= s.Config.MaxAge {
+					s.Logger.Debugf("Rotating %s", sf.path)
+					closeFile(sf)
+				}
+			}
+		case item, ok := <-s.records:
+			if !ok {
+				closeAll()
+				if lost > 0 {
+					s.Logger.Errorf("Storage %s is stopped, lost %d records", s.Config.DataDir, lost)
+				}
+				s.wg.Done()
+				return
 			}
+			var pending []chan error
+			groupErr = nil
+			handle := func(item storageItem) {
+				if item.flush != nil {
+					item.flush <- flush()
+					return
+				}
+				if item.taken != nil && !atomic.CompareAndSwapInt32(item.taken, ITEM_QUEUED, ITEM_TAKEN) {
+					return // The client already got a 503 for it
+				}
+				err := writeWithRetry(item.r)
+				if item.done == nil {
+					if err != nil {
+						lost++
+					}
+					return
+				}
+				if err != nil {
+					item.done <- err
+					return
+				}
+				pending = append(pending, item.done)
+			}
+
+			handle(item)
+			if len(pending) == 0 {
+				continue
+			}
+
+			// Group commit: write the records which are already waiting, and sync them all at once
+		group:
+			for len(pending) < MAX_GROUP_COMMIT {
+				select {
+				case item, ok := <-s.records:
+					if !ok {
+						break group // Picked up by the next loop
+					}
+					handle(item)
+				default:
+					break group
+				}
+			}
+			err := sync()
+			if err != nil {
+				s.Logger.Errorf("Could not sync: %v", err)
+			} else {
+				err = groupErr
+			}
+			for _, ch := range pending {
+				ch <- err
+			}
+		}
+	}
+}
+
+// checkInterval returns how often open files should be checked for IdleClose and MaxAge, or 0 if they shouldn't
+func (s *Storage) checkInterval() time.Duration {
+	interval := s.Config.IdleClose
+	if s.Config.MaxAge > 0 && (interval == 0 || s.Config.MaxAge < interval) {
+		interval = s.Config.MaxAge
+	}
+	if interval == 0 {
+		return 0
+	}
+	interval /= 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+func (c *StorageConfig) queueSize() int {
+	if c.QueueSize < 1 {
+		return DEFAULT_QUEUE_SIZE
+	}
+	return c.QueueSize
+}
+
+func (s *Storage) syncInterval() time.Duration {
+	if s.Config.SyncInterval <= 0 {
+		return DEFAULT_SYNC_INTERVAL
+	}
+	return s.Config.SyncInterval
+}
+
+func (s *Storage) shouldRotate(sf *storageFile) bool {
+	c := s.Config
+	return (c.MaxRecords > 0 && sf.records >= c.MaxRecords) ||
+		(c.MaxBytes > 0 && sf.size.n >= c.MaxBytes) ||
+		(c.MaxAge > 0 && time.Since(sf.opened) >= c.MaxAge)
+}
+
+func (s *Storage) maxOpenFiles() int {
+	if s.Config.MaxOpenFiles < 1 {
+		return 1
+	}
+	return s.Config.MaxOpenFiles
+}
+
+func (s *Storage) openFile(filename string, v *pathValues) (*storageFile, error) {
+	format := storageFormats[s.Config.Format]
+
+	sf := &storageFile{
+		name:     filename,
+		finalize: s.Config.Finalize,
+		opened:   time.Now(),
+		fsync:    s.Config.Durability != DURABILITY_NONE,
+	}
 
-			of, err = os.OpenFile(filename, openFlags, 0666)
+	openFlags := os.O_APPEND | os.O_WRONLY
+	if s.Config.appendable() {
+		// Compressed files are appended to as well, as a new gzip member or zstd frame
+		sf.path = filename
+	} else {
+		// Start a new file with the next free {seq}
+		for sf.path = s.determineStoragePath(v); ; sf.path = s.determineStoragePath(v) {
+			used, err := pathUsed(sf.path)
 			if err != nil {
-				s.Logger.Errorf("Could not open %s: %v", filename, err)
-				panic(err)
+				return nil, err // ie. a parent is not a directory, any seq would fail
 			}
-			cw = csv.NewWriter(of)
-			cw.Comma = '\t' // Create TSV
-			ofName = filename
+			if !used {
+				break
+			}
+			v.seq++
 		}
+		openFlags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	sf.seq = v.seq
+	sf.writePath = sf.path
+	if sf.finalize == FINALIZE_RENAME {
+		sf.writePath += INPROGRESS_SUFFIX
+	}
+
+	// Claimed first, so that the file (and its directory) isn't expired meanwhile
+	only := claimFile(sf.writePath)
+	if err := os.MkdirAll(filepath.Dir(sf.path), os.ModeDir|os.ModePerm); err != nil {
+		releaseFile(sf.writePath)
+		return nil, err
+	}
+	if openFlags&os.O_EXCL == 0 && !fileExists(sf.writePath) {
+		openFlags |= os.O_CREATE
+	}
+
+	// Existing files might end with a partial record if the process was killed, cut it before appending. Unless another Storage is writing to the file.
+	if only && openFlags&os.O_CREATE == 0 && !s.checked[sf.path] {
+		if err := s.repair(sf.writePath); err != nil {
+			releaseFile(sf.writePath)
+			return nil, err
+		}
+	}
 
-		err = cw.Write(s.recordToStorageFormat(r))
+	f, err := os.OpenFile(sf.writePath, openFlags, 0666)
+	if err != nil {
+		releaseFile(sf.writePath)
+		return nil, err
+	}
+	sf.f = f
+	if sf.fsync && openFlags&os.O_CREATE != 0 {
+		if err := syncDir(filepath.Dir(sf.writePath)); err != nil {
+			f.Close()
+			releaseFile(sf.writePath)
+			return nil, err
+		}
+	}
+	sf.size = &countingWriter{w: f}
+
+	var w io.Writer = sf.size
+	if newWriter := compressions[s.Config.Compression].newWriter; newWriter != nil && !format.ownCompression {
+		sf.cw, err = newWriter(w)
 		if err != nil {
-			s.Logger.Errorf("Could not write record %s: %v", r, err)
-			panic(err)
+			f.Close()
+			releaseFile(sf.writePath)
+			return nil, err
 		}
+		w = sf.cw
+	}
+	sf.rw = format.newWriter(w, s.Schema, s.Config.Compression)
+	if s.Config.appendable() {
+		s.checked[sf.path] = true
 	}
 
-	closeOpenFile()
-	s.wg.Done()
+	return sf, nil
 }
 
-func (s *Storage) Enqueue(r *EventRecord) {
-	s.records <- r
+func (sf *storageFile) flush() error {
+	if err := sf.rw.Flush(); err != nil {
+		return err
+	}
+	if sf.cw != nil {
+		return sf.cw.Flush()
+	}
+	return nil
 }
 
-func (s *Storage) recordToStorageFormat(r *EventRecord) []string {
-	jsonData, _ := json.Marshal(r.data)
+// sync flushes and fsyncs the file if it was written to since the last sync
+func (sf *storageFile) sync() error {
+	if !sf.dirty {
+		return nil
+	}
+	if err := sf.flush(); err != nil {
+		return err
+	}
+	if err := sf.f.Sync(); err != nil {
+		return err
+	}
+	sf.dirty = false
+	return nil
+}
+
+// close finalizes the file format and the compressed stream, closes the file and marks it as complete
+func (sf *storageFile) close() error {
+	defer releaseFile(sf.writePath)
+
+	err := sf.rw.Close()
+	if err == nil && sf.cw != nil {
+		err = sf.cw.Close()
+	}
+	if err == nil && sf.fsync {
+		err = sf.f.Sync()
+	}
+	if cerr := sf.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	switch sf.finalize {
+	case FINALIZE_RENAME:
+		err = os.Rename(sf.writePath, sf.path)
+	case FINALIZE_DONE:
+		err = ioutil.WriteFile(sf.path+DONE_SUFFIX, nil, 0666)
+	}
+	if err == nil && sf.fsync && sf.finalize != FINALIZE_NONE {
+		err = syncDir(filepath.Dir(sf.path))
+	}
+	return err
+}
 
-	return []string{
-		strconv.FormatInt(r.tsReceived, 10), // timestamp
-		string(jsonData),                    // json data
+// syncDir makes created and renamed files in the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
 	}
+	return err
 }
 
-func (s *Storage) determineStoragePath(r *EventRecord) (dir, fileWithDir string) {
-	t := time.Now()
-	dirPrefix := t.Format(DIRECTORY_FORMAT)
-	dir = strings.Replace(fmt.Sprintf("%s/%s", s.Config.DataDir, dirPrefix), "{event}", r.name, -1)
+// Enqueue returns after the record is on disk in DURABILITY_SYNC mode.
+// While the storage is failing, records are rejected with an UnavailableError instead of waiting for the worker.
+func (s *Storage) Enqueue(r *EventRecord) error {
+	s.mu.Lock()
+	err, failing := s.err, s.failing
+	s.mu.Unlock()
+	if err != nil {
+		return &UnavailableError{Err: err}
+	}
 
-	filename := strings.Replace(t.Format(FILE_FORMAT), "{event}", r.name, -1)
-	fileWithDir = fmt.Sprintf("%s%s", dir, filename)
-	return
+	item := storageItem{r: r}
+	if s.Config.Durability == DURABILITY_SYNC {
+		item.done = make(chan error, 1)
+		item.taken = new(int32)
+	}
+	if err := s.send(item, failing); err != nil {
+		return err
+	}
+	if item.done == nil {
+		return nil
+	}
+
+	select {
+	case err = <-item.done:
+	case <-failing:
+		if atomic.CompareAndSwapInt32(item.taken, ITEM_QUEUED, ITEM_WITHDRAWN) {
+			return &UnavailableError{Err: s.Health()} // It won't be written, so the client can retry it
+		}
+		err = <-item.done // Being written (and retried) by the worker
+	}
+	if err != nil {
+		return &UnavailableError{Err: err}
+	}
+	return nil
+}
+
+// send hands the record to the worker. Stop waits for it, so that records isn't closed during the send.
+func (s *Storage) send(item storageItem, failing chan struct{}) error {
+	s.sendMu.RLock()
+	defer s.sendMu.RUnlock()
+	if s.stopped {
+		return &UnavailableError{Err: errStorageStopped}
+	}
+	select {
+	case s.records <- item:
+		return nil
+	case <-failing:
+		return &UnavailableError{Err: s.Health()}
+	default:
+		return s.enqueueFull(item, failing)
+	}
+}
+
+// enqueueFull is called by send if the queue is full
+func (s *Storage) enqueueFull(item storageItem, failing chan struct{}) error {
+	timeout := s.Config.QueueTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_QUEUE_TIMEOUT
+	}
+	if s.Config.QueueFull == QUEUE_FULL_REJECT {
+		return &UnavailableError{Err: errQueueFull, RetryAfter: timeout}
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s.records <- item:
+		return nil
+	case <-failing:
+		return &UnavailableError{Err: s.Health()}
+	case <-t.C:
+		s.Logger.Debugf("Queue is full, rejecting %s", item.r)
+		return &UnavailableError{Err: errQueueFull, RetryAfter: timeout}
+	}
 }
 
-func (s *Storage) ensureDir(dir string) {
-	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
-		s.Logger.Errorf("Could not create %s: %v", dir, err)
-		panic(err)
+// fileExt returns the file extension for the storage format and compression
+func fileExt(format, compression string) string {
+	f := storageFormats[format]
+	if f.ownCompression {
+		return f.ext
+	}
+	return f.ext + compressions[compression].ext
+}
+
+// partitionTime returns the time which determines the file of the record
+func (s *Storage) partitionTime(r *EventRecord) time.Time {
+	if s.Config.Partition == PARTITION_EVENT {
+		if ts, ok := r.data["ts"].(int); ok { // Always set by extractTimestamp
+			return time.Unix(int64(ts), 0)
+		}
+	}
+	return time.Unix(0, r.tsReceived)
+}
+
+func (s *Storage) pathValues(r *EventRecord) *pathValues {
+	return &pathValues{
+		event: r.name,
+		host:  hostname,
+		ext:   fileExt(s.Config.Format, s.Config.Compression),
+		t:     s.partitionTime(r),
+	}
+}
+
+func (s *Storage) determineStoragePath(v *pathValues) string {
+	return filepath.Join(s.Config.DataDir, s.path.render(v))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// pathUsed tells if there's a file (complete or not) with the path
+func pathUsed(path string) (bool, error) {
+	for _, p := range []string{path, path + INPROGRESS_SUFFIX, path + DONE_SUFFIX} {
+		_, err := os.Stat(p)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
 	}
+	return false, nil
 }
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"github.com/alexcesaro/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFileStorage(t *testing.T, c EventStorageConfig) *Storage {
+	e := NewEventType("test")
+	sc := c.withDefaults(&StorageConfig{Format: STORAGE_FORMAT_NDJSON, Compression: COMPRESSION_NONE})
+	s, err := newFileStorage(&e, sc, log.NullLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// A sync record which is still queued when the storage starts failing is rejected and not written, the one being written is waited for
+func TestStorageSyncFailing(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	s := testFileStorage(t, EventStorageConfig{DataDir: filepath.Join(blocker, "data"), Path: "{event}.{ext}", Durability: DURABILITY_SYNC})
+	start := make(chan struct{})
+	s.after = append(s.after, start)
+	s.RunInBackground()
+
+	results := make([]chan error, 2)
+	for i := range results {
+		results[i] = make(chan error, 1)
+		r := &EventRecord{name: "test", tsReceived: time.Now().UnixNano(), data: map[string]interface{}{"i": i}}
+		go func(ch chan error) { ch <- s.Enqueue(r) }(results[i])
+		for depth, _ := s.QueueDepth(); depth <= i; depth, _ = s.QueueDepth() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(start)
+
+	select {
+	case err := <-results[1]:
+		if _, ok := err.(*UnavailableError); !ok {
+			t.Fatalf("queued record got %v, should be an UnavailableError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued record wasn't rejected")
+	}
+	select {
+	case err := <-results[0]:
+		t.Fatalf("record being written returned %v before it was written", err)
+	default:
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-results[0]:
+		if err != nil {
+			t.Fatalf("record being written got %v, should be written once the storage recovers", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("record being written wasn't written")
+	}
+	s.Stop()
+
+	data, err := ioutil.ReadFile(filepath.Join(blocker, "data", "test.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"i":0`) {
+		t.Errorf("file should only have the first record:\n%s", data)
+	}
+}
+
+func TestCheckDurability(t *testing.T) {
+	tests := []struct {
+		defaults StorageConfig
+		sink     EventStorageConfig
+		valid    bool
+	}{
+		{StorageConfig{Format: STORAGE_FORMAT_PARQUET, Durability: DURABILITY_PERIODIC}, EventStorageConfig{}, true},
+		{StorageConfig{Format: STORAGE_FORMAT_NDJSON, Durability: DURABILITY_SYNC}, EventStorageConfig{}, true},
+		{StorageConfig{Format: STORAGE_FORMAT_PARQUET, Durability: DURABILITY_SYNC}, EventStorageConfig{}, false},
+		{StorageConfig{Format: STORAGE_FORMAT_NDJSON, Durability: DURABILITY_SYNC}, EventStorageConfig{Format: STORAGE_FORMAT_PARQUET}, false},
+		{StorageConfig{Format: STORAGE_FORMAT_PARQUET}, EventStorageConfig{Durability: DURABILITY_SYNC}, false},
+		{StorageConfig{Format: STORAGE_FORMAT_PARQUET, Durability: DURABILITY_SYNC}, EventStorageConfig{Type: SINK_TYPE_KAFKA}, true},
+	}
+	for i, tt := range tests {
+		ec := &EventsConfig{Events: []EventTypeConfig{{Name: "test", Storage: tt.sink}}}
+		configs := [][]*EventStorageConfig{ec.Events[0].storageConfigs(&tt.defaults)}
+		if err := checkDurability(ec, configs); (err == nil) != tt.valid {
+			t.Errorf("tests[%d]: checkDurability() is %v, valid should be %v", i, err, tt.valid)
+		}
+	}
+}
+
+func TestCheckFilePaths(t *testing.T) {
+	file := func(name, dir, path string) EventStorageConfig {
+		return EventStorageConfig{Name: name, DataDir: dir, Path: path}
+	}
+	tests := []struct {
+		name   string
+		events map[string][]EventStorageConfig // Sinks by event type
+		err    string                          // Part of the error, empty if there should be none
+	}{
+		{"default paths", map[string][]EventStorageConfig{"a": {file("", "", "")}, "b": {file("", "", "")}}, ""},
+		{"without event", map[string][]EventStorageConfig{"a": {file("", "", "{yyyy}/{hh}.{ext}")}, "b": {file("", "", "{yyyy}/{hh}.{ext}")}}, "can write to the same file"},
+		{"different datadirs", map[string][]EventStorageConfig{"a": {file("", "/data/a", "{hh}.{ext}")}, "b": {file("", "/data/b", "{hh}.{ext}")}}, ""},
+		{"nested datadirs", map[string][]EventStorageConfig{"a": {file("", "/data", "{event}/{hh}.{ext}")}, "b": {file("", "/data/a", "{hh}.{ext}")}}, "can write to the same file"},
+		{"sinks of an event type", map[string][]EventStorageConfig{"a": {file("one", "", ""), file("two", "", "")}}, "can write to the same file"},
+		{"sinks in different dirs", map[string][]EventStorageConfig{"a": {file("one", "", "one/{hh}.{ext}"), file("two", "", "two/{hh}.{ext}")}}, ""},
+		{"different formats", map[string][]EventStorageConfig{"a": {file("one", "", ""), {Name: "two", Format: STORAGE_FORMAT_TSV}}}, ""},
+		{"token and event name", map[string][]EventStorageConfig{"12": {file("", "", "{yyyy}/{event}.{ext}")}, "a": {file("", "", "{yyyy}/{mm}.{ext}")}}, "can write to the same file"},
+		{"token and other event name", map[string][]EventStorageConfig{"ab": {file("", "", "{yyyy}/{event}.{ext}")}, "a": {file("", "", "{yyyy}/{mm}.{ext}")}}, ""},
+		{"archive in datadir", map[string][]EventStorageConfig{"a": {{ArchiveDir: "/data/archive"}}}, "should be outside of the datadir (/data)"},
+		{"archive in other datadir", map[string][]EventStorageConfig{"a": {{DataDir: "/data/a", ArchiveDir: "/data/b/archive"}}, "b": {file("", "/data/b", "")}}, "should be outside of the datadir of"},
+		{"archive outside", map[string][]EventStorageConfig{"a": {{ArchiveDir: "/archive"}}}, ""},
+		{"webhook dead letter", map[string][]EventStorageConfig{"a": {file("file", "", "deadletter/{event}_webhook.jsonl"), {Name: "webhook", Type: SINK_TYPE_WEBHOOK, Webhook: &WebhookConfig{}}}}, "webhook.dead_letter"},
+		{"webhook default dead letter", map[string][]EventStorageConfig{"a": {file("file", "", ""), {Name: "webhook", Type: SINK_TYPE_WEBHOOK, Webhook: &WebhookConfig{}}}}, ""},
+		{"other sink types", map[string][]EventStorageConfig{"a": {file("file", "", ""), {Name: "kafka", Type: SINK_TYPE_KAFKA}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaults := &StorageConfig{DataDir: "/data", Format: STORAGE_FORMAT_NDJSON, Compression: COMPRESSION_NONE}
+			ec := &EventsConfig{}
+			var configs [][]*EventStorageConfig
+			for _, name := range []string{"12", "a", "ab", "b"} { // In a fixed order
+				sinks, ok := tt.events[name]
+				if !ok {
+					continue
+				}
+				e := EventTypeConfig{Name: name, Sinks: sinks}
+				ec.Events = append(ec.Events, e)
+				configs = append(configs, e.storageConfigs(defaults))
+			}
+
+			err := checkFilePaths(ec, configs)
+			if tt.err == "" && err != nil {
+				t.Errorf("checkFilePaths() is %v, should be nil", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("checkFilePaths() is %v, should contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexcesaro/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const SINK_TYPE_WEBHOOK = "webhook"
+
+const (
+	DEFAULT_WEBHOOK_BATCH_SIZE       = 100
+	DEFAULT_WEBHOOK_LINGER           = time.Second
+	DEFAULT_WEBHOOK_TIMEOUT          = 10 * time.Second
+	DEFAULT_WEBHOOK_MAX_RETRIES      = 5
+	DEFAULT_WEBHOOK_SIGNATURE_HEADER = "X-Signature-256"
+	DEFAULT_WEBHOOK_DEAD_LETTER      = "deadletter/{event}_{sink}.jsonl" // Not the extension of a storage file, so it's not repaired or expired as one
+)
+
+func init() {
+	RegisterSink(SINK_TYPE_WEBHOOK, newWebhookSink)
+}
+
+// WebhookConfig is the destination of a webhook sink
+type WebhookConfig struct {
+	URL             string            `json:"url" yaml:"url"`
+	Headers         map[string]string `json:"headers" yaml:"headers"`                   // Added to each request, ie. Authorization
+	Template        string            `json:"template" yaml:"template"`                 // text/template of the JSON payload, see webhookBatch
+	Secret          string            `json:"secret" yaml:"secret"`                     // Key of the HMAC-SHA256 signature of the payload, not signed if empty
+	SignatureHeader string            `json:"signature_header" yaml:"signature_header"` // Header of the signature, sent as sha256=<hex>
+	BatchSize       int               `json:"batch_size" yaml:"batch_size"`             // Max events in a request
+	Linger          Duration          `json:"linger" yaml:"linger"`                     // How long to wait for a batch to fill up
+	Timeout         Duration          `json:"timeout" yaml:"timeout"`                   // Of each request
+	MaxRetries      int               `json:"max_retries" yaml:"max_retries"`           // Retries of a failed request before it's written to the dead-letter file, -1 for none
+	DeadLetter      string            `json:"dead_letter" yaml:"dead_letter"`           // File under datadir, {event} and {sink} are replaced
+}
+
+func (c *WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url: should be an http or https URL")
+	}
+	if c.Template != "" {
+		if _, err := parseWebhookTemplate(c.Template); err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("batch_size: can't be negative")
+	}
+	if c.MaxRetries < -1 {
+		return fmt.Errorf("max_retries: should be -1 or more")
+	}
+	if c.DeadLetter != "" {
+		if filepath.IsAbs(c.DeadLetter) {
+			return fmt.Errorf("dead_letter: should be relative to datadir")
+		}
+		if err := checkPathComponents(c.DeadLetter); err != nil {
+			return fmt.Errorf("dead_letter: %v", err)
+		}
+		if _, _, ok := formatOfPath(strings.TrimSuffix(c.DeadLetter, INPROGRESS_SUFFIX)); ok {
+			return fmt.Errorf("dead_letter: can't have the extension of a storage file, it would be repaired and expired like one")
+		}
+	}
+	return nil
+}
+
+// webhookBatch is the data of the payload template. Without a template, it's sent as JSON.
+type webhookBatch struct {
+	Event  string          `json:"event"`
+	Events []*ndjsonRecord `json:"events"`
+}
+
+// parseWebhookTemplate parses a payload template. The json function encodes a value as JSON, ie. {"items":{{json .Events}}}
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+// webhookError is an unsuccessful response
+type webhookError struct {
+	status int
+	body   string
+}
+
+func (e *webhookError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("HTTP %d", e.status)
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.status, e.body)
+}
+
+// temporary responses are retried, other errors are written to the dead-letter file right away
+func (e *webhookError) temporary() bool {
+	return e.status >= 500 || e.status == http.StatusRequestTimeout || e.status == http.StatusTooManyRequests
+}
+
+// WebhookSink POSTs batches of records to a URL. Requests which fail are retried with a backoff, up to MaxRetries times, and then written to a dead-letter file.
+// Events are still accepted while the endpoint is failing, until the queue is full. The sink is only failing if the dead-letter file can't be written.
+type WebhookSink struct {
+	Name       string // Event type
+	Config     WebhookConfig
+	Logger     log.Logger
+	template   *template.Template // nil for the default payload
+	deadLetter string
+	http       *http.Client
+	queue      *sinkQueue
+	done       chan struct{}
+}
+
+func newWebhookSink(e *EventType, c *EventStorageConfig, l log.Logger) (Sink, error) {
+	wc := *c.Webhook
+	if wc.SignatureHeader == "" {
+		wc.SignatureHeader = DEFAULT_WEBHOOK_SIGNATURE_HEADER
+	}
+	if wc.BatchSize == 0 {
+		wc.BatchSize = DEFAULT_WEBHOOK_BATCH_SIZE
+	}
+	if wc.Linger == 0 {
+		wc.Linger = Duration(DEFAULT_WEBHOOK_LINGER)
+	}
+	if wc.Timeout == 0 {
+		wc.Timeout = Duration(DEFAULT_WEBHOOK_TIMEOUT)
+	}
+	if wc.MaxRetries == 0 {
+		wc.MaxRetries = DEFAULT_WEBHOOK_MAX_RETRIES
+	}
+
+	s := &WebhookSink{
+		Name:       e.Name,
+		Config:     wc,
+		Logger:     l,
+		deadLetter: c.deadLetterPath(e.Name),
+		http:       &http.Client{Timeout: time.Duration(wc.Timeout)},
+		queue:      newSinkQueue(c),
+		done:       make(chan struct{}),
+	}
+	if wc.Template != "" {
+		t, err := parseWebhookTemplate(wc.Template)
+		if err != nil {
+			return nil, err
+		}
+		s.template = t
+	}
+	go s.run()
+	return s, nil
+}
+
+// deadLetterPath is the dead-letter file of a webhook sink of the event type
+func (c *EventStorageConfig) deadLetterPath(event string) string {
+	p := c.Webhook.DeadLetter
+	if p == "" {
+		p = DEFAULT_WEBHOOK_DEAD_LETTER
+	}
+	return filepath.Join(c.DataDir, strings.NewReplacer("{event}", event, "{sink}", c.Name).Replace(p))
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.done)
+	s.queue.run(s.Config.BatchSize, time.Duration(s.Config.Linger), s.send)
+}
+
+// send POSTs the records as one payload. Only fails if the payload couldn't be sent or written to the dead-letter file before the sink was closed.
+func (s *WebhookSink) send(records []*EventRecord) error {
+	payload, err := s.payload(records)
+	if err != nil {
+		return s.writeDeadLetter(len(records), payload, fmt.Errorf("Invalid payload: %v", err))
+	}
+
+	backoff := RETRY_MIN_BACKOFF
+	for attempt := 0; ; attempt++ {
+		err = s.post(payload)
+		if err == nil {
+			return nil
+		}
+		if werr, ok := err.(*webhookError); ok && !werr.temporary() {
+			break
+		}
+		if attempt >= s.Config.MaxRetries {
+			break
+		}
+		select {
+		case <-s.queue.stop:
+			s.Logger.Errorf("Sending %d records to %s: %v, giving up since the sink is stopped", len(records), s.Config.URL, err)
+			return s.writeDeadLetter(len(records), payload, err)
+		default:
+		}
+
+		s.Logger.Warningf("Sending %d records to %s: %v, retrying in %v", len(records), s.Config.URL, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-s.queue.stop:
+		}
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+	s.Logger.Errorf("Could not send %d records to %s: %v", len(records), s.Config.URL, err)
+	return s.writeDeadLetter(len(records), payload, err)
+}
+
+func (s *WebhookSink) payload(records []*EventRecord) ([]byte, error) {
+	b := webhookBatch{
+		Event:  s.Name,
+		Events: make([]*ndjsonRecord, len(records)),
+	}
+	for i, r := range records {
+		b.Events[i] = &ndjsonRecord{
+			Received: r.tsReceived,
+			Event:    r.name,
+			Data:     r.data,
+		}
+	}
+	if s.template == nil {
+		return json.Marshal(&b)
+	}
+
+	var buf bytes.Buffer
+	if err := s.template.Execute(&buf, &b); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return buf.Bytes(), errors.New("the template didn't produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *WebhookSink) post(payload []byte) error {
+	req, err := http.NewRequest("POST", s.Config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "data-api-server")
+	for k, v := range s.Config.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.Config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.Config.Secret))
+		mac.Write(payload)
+		req.Header.Set(s.Config.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(ioutil.Discard, resp.Body) // So the connection is reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// webhookDeadLetter is a line of the dead-letter file
+type webhookDeadLetter struct {
+	Failed  int64           `json:"failed"` // Timestamp in nanoseconds
+	URL     string          `json:"url"`
+	Error   string          `json:"error"`
+	Records int             `json:"records"`
+	Payload json.RawMessage `json:"payload,omitempty"` // Omitted if it's not valid JSON
+	Raw     string          `json:"raw,omitempty"`     // The payload if it's not valid JSON
+}
+
+// writeDeadLetter appends the payload to the dead-letter file, and retries while that fails. The sink is failing meanwhile.
+func (s *WebhookSink) writeDeadLetter(records int, payload []byte, reason error) error {
+	d := webhookDeadLetter{
+		Failed:  time.Now().UnixNano(),
+		URL:     s.Config.URL,
+		Error:   reason.Error(),
+		Records: records,
+	}
+	if json.Valid(payload) {
+		d.Payload = payload
+	} else {
+		d.Raw = string(payload)
+	}
+	line, err := json.Marshal(&d)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	err = s.queue.retry("Writing to "+s.deadLetter, s.Logger, func() error {
+		if err := os.MkdirAll(filepath.Dir(s.deadLetter), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.deadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		s.Logger.Errorf("Lost %d records of %s", records, s.Name)
+		return err
+	}
+	s.Logger.Warningf("Wrote %d records to %s", records, s.deadLetter)
+	return nil
+}
+
+func (s *WebhookSink) Enqueue(r *EventRecord) error {
+	return s.queue.enqueue(r)
+}
+
+// Flush sends the queued records, and returns after they're sent or written to the dead-letter file
+func (s *WebhookSink) Flush() error {
+	return s.queue.flush()
+}
+
+// Close sends the rest of the queue. If the endpoint is failing, each request is tried once and written to the dead-letter file.
+func (s *WebhookSink) Close() error {
+	s.queue.close()
+	<-s.done
+	return s.queue.health()
+}
+
+func (s *WebhookSink) Health() error {
+	return s.queue.health()
+}
+
+func (s *WebhookSink) QueueDepth() (depth, size int) {
+	return s.queue.QueueDepth()
+}